@@ -6,12 +6,13 @@ import (
 	"github.com/Laica-Lunasys/oauth2-proxy-manager/logger"
 	"github.com/Laica-Lunasys/oauth2-proxy-manager/service"
 	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-func auth() (*kubernetes.Clientset, error) {
+func auth() (*kubernetes.Clientset, dynamic.Interface, error) {
 	// Authentication
 	var config *rest.Config
 
@@ -24,7 +25,7 @@ func auth() (*kubernetes.Clientset, error) {
 		}
 		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	} else {
 		// In Cluster
@@ -38,25 +39,70 @@ func auth() (*kubernetes.Clientset, error) {
 	// creates the clientset
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return clientset, err
+	// custom resources (e.g. Traefik Middlewares)
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return clientset, dynamicClient, err
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		os.Exit(render(os.Args[2:]))
+	}
+
 	logger.Init()
 
 	logrus.Printf("[oauth2-proxy-manager] Initializing...")
-	clientset, err := auth()
+	config, err := service.LoadConfig(os.Args[1:], os.LookupEnv)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	// Fail fast before connecting to the cluster
+	if err := config.Validate(); err != nil {
+		logrus.Fatal(err)
+	}
+
+	clientset, dynamicClient, err := auth()
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
 	// Controller
-	controller, err := service.NewController(clientset)
+	controller, err := service.NewController(clientset, config)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	controller.Dynamic = dynamicClient
+	if controller.DryRun {
+		logrus.Warn("[oauth2-proxy-manager] Dry-run mode: changes are logged, nothing is written")
+	}
 
 	// Observer
-	observer, err := service.NewObserver(clientset, controller)
+	observer, err := service.NewObserver(clientset, controller, config)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	// Reload configuration without restarting
+	watcher := service.NewConfigWatcher(clientset, controller, config, os.Args[1:])
+	watcher.OnReload = observer.Resync
+	stop := make(chan struct{})
+	defer close(stop)
+	go watcher.Run(stop)
+
+	// Admission webhook
+	if len(config.WebhookAddr) != 0 {
+		webhook := service.NewWebhook(observer)
+		go func() {
+			logrus.Fatal(webhook.Run(config.WebhookAddr, config.WebhookCertFile, config.WebhookKeyFile))
+		}()
+	}
+
 	observer.Run()
 }
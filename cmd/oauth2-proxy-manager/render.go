@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/Laica-Lunasys/oauth2-proxy-manager/service"
+)
+
+// render - Print objects generated for Ingresses in the file, without connecting to the cluster.
+// Usage: oauth2-proxy-manager render -f ingress.yaml [flags]
+func render(args []string) int {
+	flags := flag.NewFlagSet("oauth2-proxy-manager render", flag.ContinueOnError)
+	filename := flags.String("f", "", "Ingress YAML to render (- for stdin)")
+
+	config, err := service.LoadConfigWithFlags(flags, args, os.LookupEnv)
+	if err != nil {
+		// Usage is printed by flags for -h
+		if err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return 2
+	}
+	if len(*filename) == 0 {
+		fmt.Fprintln(os.Stderr, "-f is required")
+		flags.Usage()
+		return 2
+	}
+	if err := config.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var data []byte
+	if *filename == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(*filename)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	controller, err := service.NewController(nil, config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	manifests, err := controller.RenderManifests(data)
+	os.Stdout.Write(manifests)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -1,12 +1,35 @@
 package models
 
+import (
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
 // ServiceSettings - Settings from individual services annotations.
 type ServiceSettings struct {
-	AppName         string
-	AuthURL         string
-	AuthSignIn      string
-	SetXAuthRequest string
-	GitHub          GitHubProvider
+	// Instance - Manager instance which claimed the app
+	Instance string
+	// IngressController - Ingress controller protecting the app (ingress.class)
+	IngressController string
+	AppName           string // Empty for oauth2_proxy shared by apps of the GitHub org
+	// AuthURL / AuthSignIn - Set by annotations of the Ingress. Empty for Traefik (ForwardAuth Middleware).
+	AuthURL           string
+	AuthSignIn        string
+	AuthHost          string
+	AuthTLSSecretName string
+	CookieDomain      string
+	WhitelistDomain   string
+	SetXAuthRequest   string
+	Image             string
+	Version           string
+	ServiceType       string
+	GitHub            GitHubProvider
+	Deployment        DeploymentSettings
+	SessionStore      SessionStoreSettings
+	// Sharing - Whether the app has its own oauth2_proxy ("per-app") or shares one of its GitHub org ("per-org")
+	Sharing string
+	// PublicPaths - Paths of the Ingress served without authentication
+	PublicPaths []string
 }
 
 // GitHubProvider - GitHub Provicer
@@ -14,3 +37,37 @@ type GitHubProvider struct {
 	Organization string
 	Teams        []string
 }
+
+// SessionStoreSettings - Session storage of oauth2_proxy. Empty fields are not set.
+type SessionStoreSettings struct {
+	Type            string
+	RedisSecretName string
+	RedisSecretKey  string
+}
+
+// DeploymentSettings - Tuning of oauth2_proxy Deployment. Empty fields are not set.
+type DeploymentSettings struct {
+	Replicas          *int32
+	Resources         apiv1.ResourceRequirements
+	NodeSelector      map[string]string
+	Tolerations       []apiv1.Toleration
+	Affinity          *apiv1.Affinity
+	SpreadTopologyKey string
+	Disruption        DisruptionSettings
+	Autoscaling       AutoscalingSettings
+}
+
+// DisruptionSettings - PodDisruptionBudget of oauth2_proxy
+type DisruptionSettings struct {
+	Enabled        *bool
+	MinAvailable   *intstr.IntOrString
+	MaxUnavailable *intstr.IntOrString
+}
+
+// AutoscalingSettings - HorizontalPodAutoscaler of oauth2_proxy
+type AutoscalingSettings struct {
+	Enabled              *bool
+	MinReplicas          *int32
+	MaxReplicas          *int32
+	TargetCPUUtilization *int32
+}
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/api/extensions/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/Laica-Lunasys/oauth2-proxy-manager/models"
+)
+
+// Ingress controllers of protected Ingresses, also their ingress.class
+const (
+	IngressControllerNginx   = "nginx"
+	IngressControllerTraefik = "traefik"
+	IngressControllerHAProxy = "haproxy"
+)
+
+// IngressAdapter - How an ingress controller delegates authentication of protected Ingresses to oauth2_proxy
+type IngressAdapter interface {
+	// Name - Name of the controller, also ingress.class of Ingresses it serves
+	Name() string
+	// checkAuth - Error if the Ingress doesn't delegate authentication (e.g. auth-url not found)
+	checkAuth(annotations map[string]string) error
+	// authURLs - auth-url / auth-signin the Ingress delegates authentication to. auth-signin is empty without sign-in redirect.
+	authURLs(ingress *v1beta1.Ingress, client dynamic.Interface) (string, string, error)
+	// signInRedirect - "rd" of auth-signin, the original request in the syntax of the controller. Empty without sign-in redirect.
+	signInRedirect() string
+	// authAnnotations - Annotations delegating authentication to authURL / authSignIn. nil if it's not configured by annotations.
+	authAnnotations(authURL, authSignIn string) [][2]string
+	// keepAnnotation - Whether annotation of protected Ingress configures the controller, not authentication (kept on Ingress of public paths)
+	keepAnnotation(key string) bool
+	// exactPath - Path of Ingress matching only path, not paths under it, with annotations it needs. false if the controller only matches prefixes.
+	exactPath(path string) (string, [][2]string, bool)
+}
+
+// ingressAdapters - Known ingress controllers
+var ingressAdapters = []IngressAdapter{
+	annotationAdapter{
+		name:     IngressControllerNginx,
+		prefix:   "nginx.ingress.kubernetes.io/",
+		redirect: "https://$host$request_uri$is_args$args",
+		// Paths are regular expressions, anchored to match exactly
+		exact: func(path string) (string, [][2]string) {
+			return "^" + regexp.QuoteMeta(path) + "$", [][2]string{{"nginx.ingress.kubernetes.io/use-regex", "true"}}
+		},
+	},
+	traefikAdapter{},
+	annotationAdapter{
+		name:     IngressControllerHAProxy,
+		prefix:   "haproxy-ingress.github.io/",
+		redirect: "https://%[hdr(host)]%[path]",
+		exact: func(path string) (string, [][2]string) {
+			return path, [][2]string{{"haproxy-ingress.github.io/path-type", "exact"}}
+		},
+	},
+}
+
+// lookupIngressAdapter - Adapter of the controller. nil if unknown.
+func lookupIngressAdapter(name string) IngressAdapter {
+	for _, adapter := range ingressAdapters {
+		if adapter.Name() == name {
+			return adapter
+		}
+	}
+	return nil
+}
+
+// appIngressAdapter - Adapter of the controller protecting the app. nginx if unknown (e.g. app identified only to be removed).
+func appIngressAdapter(settings *models.ServiceSettings) IngressAdapter {
+	if adapter := lookupIngressAdapter(settings.IngressController); adapter != nil {
+		return adapter
+	}
+	return lookupIngressAdapter(IngressControllerNginx)
+}
+
+// annotationAdapter - Controller configured by auth-url / auth-signin annotations (ingress-nginx, HAProxy Ingress)
+type annotationAdapter struct {
+	name     string
+	prefix   string
+	redirect string
+	// exact - Path matching only path, with annotations it needs. nil if the controller only matches prefixes.
+	exact func(path string) (string, [][2]string)
+}
+
+func (a annotationAdapter) Name() string {
+	return a.name
+}
+
+func (a annotationAdapter) checkAuth(annotations map[string]string) error {
+	if _, ok := annotations[a.prefix+"auth-url"]; !ok {
+		return errors.New("auth-url not found. skip.")
+	}
+	if _, ok := annotations[a.prefix+"auth-signin"]; !ok {
+		return errors.New("auth-signin not found. skip.")
+	}
+	return nil
+}
+
+func (a annotationAdapter) authURLs(ingress *v1beta1.Ingress, client dynamic.Interface) (string, string, error) {
+	return ingress.Annotations[a.prefix+"auth-url"], ingress.Annotations[a.prefix+"auth-signin"], nil
+}
+
+func (a annotationAdapter) signInRedirect() string {
+	return a.redirect
+}
+
+func (a annotationAdapter) authAnnotations(authURL, authSignIn string) [][2]string {
+	return [][2]string{
+		{a.prefix + "auth-url", authURL},
+		{a.prefix + "auth-signin", authSignIn},
+	}
+}
+
+func (a annotationAdapter) keepAnnotation(key string) bool {
+	return strings.HasPrefix(key, a.prefix) && !strings.HasPrefix(key, a.prefix+"auth-")
+}
+
+func (a annotationAdapter) exactPath(path string) (string, [][2]string, bool) {
+	if a.exact == nil {
+		return path, nil, false
+	}
+	exact, annotations := a.exact(path)
+	return exact, annotations, true
+}
+
+// traefikMiddlewaresKey - Middlewares of the router of Traefik Ingress ("<namespace>-<name>@kubernetescrd", comma separated)
+const traefikMiddlewaresKey = "traefik.ingress.kubernetes.io/router.middlewares"
+
+// traefikMiddlewareResource - Traefik v2 Middleware
+var traefikMiddlewareResource = schema.GroupVersionResource{Group: "traefik.containo.us", Version: "v1alpha1", Resource: "middlewares"}
+
+// traefikAdapter - Traefik v2, delegating authentication with ForwardAuth Middleware.
+// ForwardAuth has no sign-in redirect: unauthenticated requests get 401 of oauth2_proxy.
+type traefikAdapter struct{}
+
+func (a traefikAdapter) Name() string {
+	return IngressControllerTraefik
+}
+
+func (a traefikAdapter) checkAuth(annotations map[string]string) error {
+	if _, ok := annotations[traefikMiddlewaresKey]; !ok {
+		return errors.New("router.middlewares not found. skip.")
+	}
+	return nil
+}
+
+// authURLs - Address of the first ForwardAuth Middleware of the router.
+// Only Middlewares in the namespace of the Ingress can be read ("<namespace>-" is ambiguous otherwise).
+func (a traefikAdapter) authURLs(ingress *v1beta1.Ingress, client dynamic.Interface) (string, string, error) {
+	if client == nil {
+		return "", "", errors.New("Traefik Middlewares can't be read without dynamic client")
+	}
+	for _, ref := range strings.Split(ingress.Annotations[traefikMiddlewaresKey], ",") {
+		ref = strings.TrimSpace(ref)
+		if !strings.HasSuffix(ref, "@kubernetescrd") || !strings.HasPrefix(ref, ingress.Namespace+"-") {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(ref, ingress.Namespace+"-"), "@kubernetescrd")
+		middleware, err := client.Resource(traefikMiddlewareResource).Namespace(ingress.Namespace).Get(name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return "", "", fmt.Errorf("failed to get Middleware %s/%s: %s", ingress.Namespace, name, err)
+		}
+		if address, ok, _ := unstructured.NestedString(middleware.Object, "spec", "forwardAuth", "address"); ok {
+			return address, "", nil
+		}
+	}
+	return "", "", fmt.Errorf("%s has no ForwardAuth Middleware in namespace %s", traefikMiddlewaresKey, ingress.Namespace)
+}
+
+func (a traefikAdapter) signInRedirect() string {
+	return ""
+}
+
+func (a traefikAdapter) authAnnotations(authURL, authSignIn string) [][2]string {
+	return nil
+}
+
+// keepAnnotation - Router options except Middlewares, which include ForwardAuth
+func (a traefikAdapter) keepAnnotation(key string) bool {
+	return strings.HasPrefix(key, "traefik.ingress.kubernetes.io/") && key != traefikMiddlewaresKey
+}
+
+// exactPath - Routers of Ingress paths match prefixes (PathPrefix)
+func (a traefikAdapter) exactPath(path string) (string, [][2]string, bool) {
+	return path, nil, false
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// AnnotationError - All problems found in annotations of an Ingress
+type AnnotationError []string
+
+func (e AnnotationError) Error() string {
+	return "invalid annotations: " + strings.Join(e, "; ") + ". skip."
+}
+
+var (
+	// githubOrgPattern - Alphanumeric with single hyphens, not at the edge (max 39 characters)
+	githubOrgPattern = regexp.MustCompile(`^[A-Za-z0-9]+(-[A-Za-z0-9]+)*$`)
+	// githubTeamPattern - Team slug (e.g. "dev-team", "sre_oncall")
+	githubTeamPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+)
+
+const githubOrgMaxLength = 39
+
+// validateAppName - app-name is a part of object names, must be DNS label
+func validateAppName(value string) []string {
+	errs := []string{}
+	for _, msg := range validation.IsDNS1123Label(value) {
+		errs = append(errs, fmt.Sprintf("app-name %q is invalid: %s", value, msg))
+	}
+	return errs
+}
+
+func validateGitHubOrg(value string) []string {
+	if len(value) == 0 {
+		return []string{"github-org is empty"}
+	}
+	if len(value) > githubOrgMaxLength || !githubOrgPattern.MatchString(value) {
+		return []string{fmt.Sprintf("github-org %q is invalid: must be alphanumeric or single hyphens, up to %d characters", value, githubOrgMaxLength)}
+	}
+	return nil
+}
+
+// parseGitHubTeams - "admin, dev" => ["admin", "dev"]. Whitespace is trimmed, duplicates are removed.
+func parseGitHubTeams(value string) ([]string, []string) {
+	if len(strings.TrimSpace(value)) == 0 {
+		return nil, []string{"github-teams is empty"}
+	}
+
+	teams := []string{}
+	errs := []string{}
+	seen := map[string]bool{}
+	for i, team := range strings.Split(value, ",") {
+		team = strings.TrimSpace(team)
+		if len(team) == 0 {
+			errs = append(errs, fmt.Sprintf("github-teams %q has empty entry at %d", value, i+1))
+			continue
+		}
+		if !githubTeamPattern.MatchString(team) {
+			errs = append(errs, fmt.Sprintf("github-teams %q is invalid: must be team slug", team))
+			continue
+		}
+		if seen[team] {
+			continue
+		}
+		seen[team] = true
+		teams = append(teams, team)
+	}
+	return teams, errs
+}
+
+// parsePublicPaths - "/healthz, /static/" => ["/healthz", "/static/"]. Paths are served without authentication.
+func parsePublicPaths(value string) ([]string, []string) {
+	paths := []string{}
+	errs := []string{}
+	seen := map[string]bool{}
+	for _, path := range strings.Split(value, ",") {
+		path = strings.TrimSpace(path)
+		if len(path) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(path, "/") || strings.ContainsAny(path, " \t") {
+			errs = append(errs, fmt.Sprintf("public-paths %q is invalid: must be absolute path", path))
+			continue
+		}
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		paths = append(paths, path)
+	}
+	return paths, errs
+}
@@ -0,0 +1,486 @@
+package service
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// DefaultResyncPeriod - Interval to apply every observed Ingress again
+const DefaultResyncPeriod = 10 * time.Minute
+
+// Config - Configuration of the manager.
+// Loaded from YAML file (--config), environment variables and flags; later one wins.
+type Config struct {
+	Domain          string `json:"domain"`
+	CookieDomain    string `json:"cookieDomain"`
+	CookieSalt      string `json:"cookieSalt"`
+	WhitelistDomain string `json:"whitelistDomain"`
+	Provider        string `json:"provider"`
+	ClientID        string `json:"clientID"`
+	ClientSecret    string `json:"clientSecret"`
+	Image           string `json:"image"`
+	Version         string `json:"version"`
+
+	IngressClass  string `json:"ingressClass"`
+	IngressMode   string `json:"ingressMode"`
+	TLSSecretName string `json:"tlsSecretName"`
+	TLSHosts      string `json:"tlsHosts"`
+	ClusterIssuer string `json:"certManagerClusterIssuer"`
+	Issuer        string `json:"certManagerIssuer"`
+	// Gateway - Gateway API Gateway ("<namespace>/<name>") serving oauth2_proxy instead of Ingress
+	Gateway string `json:"gateway"`
+
+	// Scope of observed Ingresses
+	WatchNamespaces   string `json:"watchNamespaces"`
+	IngressSelector   string `json:"ingressSelector"`
+	NamespaceSelector string `json:"namespaceSelector"`
+	// IngressControllers - Comma separated ingress controllers of protected Ingresses (default: nginx)
+	IngressControllers string `json:"ingressControllers"`
+
+	// Where configuration of the manager lives, watched for reload
+	Namespace     string `json:"namespace"`
+	ConfigMapName string `json:"configMapName"`
+	SecretName    string `json:"secretName"`
+
+	// Identity of this manager, to run multiple managers in a cluster
+	AnnotationPrefix string `json:"annotationPrefix"`
+	Instance         string `json:"instance"`
+
+	// Admission webhook, disabled without address
+	WebhookAddr     string `json:"webhookAddr"`
+	WebhookCertFile string `json:"webhookCertFile"`
+	WebhookKeyFile  string `json:"webhookKeyFile"`
+
+	// ResyncPeriod - Interval to apply every observed Ingress again, correcting drift missed by watches. "0" disables.
+	ResyncPeriod string `json:"resyncPeriod"`
+
+	// DryRun - Log changes instead of writing them
+	DryRun bool `json:"dryRun"`
+
+	// Proxy - Defaults of generated oauth2_proxy, keyed by annotation name (e.g. "cpu-request")
+	Proxy map[string]string `json:"proxy"`
+}
+
+// configField - Binding of a Config field to its flag and environment variable
+type configField struct {
+	flag  string
+	env   string
+	usage string
+	value *string
+}
+
+func (cfg *Config) fields() []configField {
+	return []configField{
+		{"domain", "OAUTH2_PROXY_DOMAIN", "Host serving oauth2_proxy (e.g. auth.example.com)", &cfg.Domain},
+		{"cookie-domain", "COOKIE_DOMAIN", "Cookie domain of oauth2_proxy (e.g. .example.com)", &cfg.CookieDomain},
+		{"cookie-salt", "COOKIE_SALT", "Salt of generated cookie secrets", &cfg.CookieSalt},
+		{"whitelist-domain", "WHITELIST_DOMAIN", "Allowed redirect domain (e.g. .example.com)", &cfg.WhitelistDomain},
+		{"provider", "PROVIDER", "OAuth provider", &cfg.Provider},
+		{"client-id", "OAUTH2_PROXY_CLIENT_ID", "OAuth client ID", &cfg.ClientID},
+		{"client-secret", "OAUTH2_PROXY_CLIENT_SECRET", "OAuth client secret", &cfg.ClientSecret},
+		{"image", "OAUTH2_PROXY_IMAGE", "oauth2_proxy image repository", &cfg.Image},
+		{"version", "OAUTH2_PROXY_VERSION", "oauth2_proxy version", &cfg.Version},
+		{"ingress-class", "INGRESS_CLASS", "Ingress class of generated Ingress (default: controller of protected Ingress)", &cfg.IngressClass},
+		{"ingress-mode", "INGRESS_MODE", "Ingress mode (shared / per-app)", &cfg.IngressMode},
+		{"ingress-controllers", "INGRESS_CONTROLLERS", "Comma separated ingress controllers of protected Ingresses (nginx, traefik, haproxy; default: nginx)", &cfg.IngressControllers},
+		{"tls-secret-name", "TLS_SECRET_NAME", "TLS secret of TLS hosts", &cfg.TLSSecretName},
+		{"tls-hosts", "TLS_HOSTS", "Comma separated TLS hosts", &cfg.TLSHosts},
+		{"cert-manager-cluster-issuer", "CERT_MANAGER_CLUSTER_ISSUER", "cert-manager ClusterIssuer of generated Ingress", &cfg.ClusterIssuer},
+		{"cert-manager-issuer", "CERT_MANAGER_ISSUER", "cert-manager Issuer of generated Ingress", &cfg.Issuer},
+		{"gateway", "GATEWAY", "Gateway serving oauth2_proxy by HTTPRoute, as <namespace>/<name> (default: Ingress)", &cfg.Gateway},
+		{"watch-namespaces", "WATCH_NAMESPACES", "Comma separated namespaces to observe (default: all)", &cfg.WatchNamespaces},
+		{"ingress-selector", "INGRESS_SELECTOR", "Label selector of observed Ingresses (e.g. oauth2-proxy=enabled)", &cfg.IngressSelector},
+		{"namespace-selector", "NAMESPACE_SELECTOR", "Label selector of namespaces of observed Ingresses (e.g. tenant=a)", &cfg.NamespaceSelector},
+		{"config-namespace", "POD_NAMESPACE", "Namespace of manager ConfigMap / Secret", &cfg.Namespace},
+		{"config-map", "CONFIG_MAP_NAME", "ConfigMap of the manager, reloaded on change", &cfg.ConfigMapName},
+		{"config-secret", "CONFIG_SECRET_NAME", "Secret of the manager, reloaded on change", &cfg.SecretName},
+		{"annotation-prefix", "ANNOTATION_PREFIX", "Prefix of annotations claimed by this manager", &cfg.AnnotationPrefix},
+		{"webhook-addr", "WEBHOOK_ADDR", "Address serving admission webhook (e.g. :8443, default: disabled)", &cfg.WebhookAddr},
+		{"webhook-tls-cert-file", "WEBHOOK_TLS_CERT_FILE", "TLS certificate of admission webhook", &cfg.WebhookCertFile},
+		{"webhook-tls-key-file", "WEBHOOK_TLS_KEY_FILE", "TLS private key of admission webhook", &cfg.WebhookKeyFile},
+		{"resync-period", "RESYNC_PERIOD", "Interval to apply every observed Ingress again (e.g. 10m, 0 to disable)", &cfg.ResyncPeriod},
+		{"instance", "INSTANCE_NAME", "Instance name, suffix of shared object names (default: none)", &cfg.Instance},
+	}
+}
+
+// proxyOptionKeys - Keys of Config.Proxy. Environment variable is OAUTH2_PROXY_<KEY>.
+var proxyOptionKeys = []string{
+	"replicas",
+	"cpu-request", "memory-request", "cpu-limit", "memory-limit",
+	"node-selector", "tolerations", "affinity", "spread-topology-key",
+	"pdb", "pdb-min-available", "pdb-max-unavailable",
+	"hpa", "hpa-min-replicas", "hpa-max-replicas", "hpa-target-cpu",
+	"run-as-user", "service-type",
+	"session-store", "redis-secret-name", "redis-secret-key", "managed-redis", "redis-image",
+	"sharing",
+}
+
+// proxyOptionEnv - "cpu-request" => "OAUTH2_PROXY_CPU_REQUEST"
+func proxyOptionEnv(key string) string {
+	return "OAUTH2_PROXY_" + strings.ToUpper(strings.Replace(key, "-", "_", -1))
+}
+
+// proxyOptionFlag - Repeatable --proxy-option key=value
+type proxyOptionFlag map[string]string
+
+func (f proxyOptionFlag) String() string {
+	return ""
+}
+
+func (f proxyOptionFlag) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("expected key=value")
+	}
+	f[kv[0]] = kv[1]
+	return nil
+}
+
+// LoadConfig - Load configuration from YAML file (--config), environment variables and flags.
+// lookupEnv is os.LookupEnv, except when reloading.
+func LoadConfig(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	return LoadConfigWithFlags(flag.NewFlagSet("oauth2-proxy-manager", flag.ContinueOnError), args, lookupEnv)
+}
+
+// LoadConfigWithFlags - LoadConfig with own flags of subcommand (e.g. render -f)
+func LoadConfigWithFlags(flags *flag.FlagSet, args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	cfg := &Config{}
+
+	configFile := flags.String("config", "", "Path to YAML configuration file")
+	values := map[string]*string{}
+	for _, field := range cfg.fields() {
+		values[field.flag] = flags.String(field.flag, "", fmt.Sprintf("%s (env: %s)", field.usage, field.env))
+	}
+	dryRun := flags.Bool("dry-run", false, "Log changes instead of writing them (env: DRY_RUN)")
+	proxyOptions := proxyOptionFlag{}
+	flags.Var(proxyOptions, "proxy-option", "Default of generated oauth2_proxy as key=value (env: OAUTH2_PROXY_<KEY>)")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// YAML file
+	if len(*configFile) != 0 {
+		data, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("%s: %s", *configFile, err)
+		}
+	}
+	if cfg.Proxy == nil {
+		cfg.Proxy = map[string]string{}
+	}
+
+	// Environment variables
+	for _, field := range cfg.fields() {
+		if value, ok := lookupEnv(field.env); ok && len(value) != 0 {
+			*field.value = value
+		}
+	}
+	for _, key := range proxyOptionKeys {
+		if value, ok := lookupEnv(proxyOptionEnv(key)); ok && len(value) != 0 {
+			cfg.Proxy[key] = value
+		}
+	}
+	if value, ok := lookupEnv("DRY_RUN"); ok && len(value) != 0 {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("DRY_RUN %q is invalid: must be true or false", value)
+		}
+		cfg.DryRun = b
+	}
+
+	// Flags
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "dry-run" {
+			cfg.DryRun = *dryRun
+		}
+		for _, field := range cfg.fields() {
+			if field.flag == f.Name {
+				*field.value = *values[f.Name]
+			}
+		}
+	})
+	for key, value := range proxyOptions {
+		cfg.Proxy[key] = value
+	}
+
+	// Defaults
+	if len(cfg.Provider) == 0 {
+		cfg.Provider = "github"
+	}
+	if len(cfg.Version) == 0 {
+		cfg.Version = DefaultProxyVersion
+	}
+	if len(cfg.IngressMode) == 0 {
+		cfg.IngressMode = IngressModeShared
+	}
+	if len(cfg.Namespace) == 0 {
+		cfg.Namespace = "oauth2-proxy"
+	}
+	if len(cfg.ConfigMapName) == 0 {
+		cfg.ConfigMapName = "oauth2-proxy-manager-config"
+	}
+	if len(cfg.SecretName) == 0 {
+		cfg.SecretName = "oauth2-proxy-manager-secret"
+	}
+	if len(cfg.ResyncPeriod) == 0 {
+		cfg.ResyncPeriod = DefaultResyncPeriod.String()
+	}
+	if len(cfg.AnnotationPrefix) == 0 {
+		cfg.AnnotationPrefix = DefaultAnnotationPrefix
+	}
+	return cfg, nil
+}
+
+// ConfigError - All problems found in configuration
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e, "\n  - ")
+}
+
+// validateDomain - Domain (".example.com") or host. Returns problems found.
+func validateDomain(name, value string) []string {
+	errs := []string{}
+	for _, msg := range validation.IsDNS1123Subdomain(strings.TrimPrefix(value, ".")) {
+		errs = append(errs, fmt.Sprintf("%s %q is invalid: %s", name, value, msg))
+	}
+	return errs
+}
+
+// Validate - Check required fields and syntax. Returns ConfigError listing every problem.
+func (cfg *Config) Validate() error {
+	errs := ConfigError{}
+	required := func(name, value string) bool {
+		if len(value) == 0 {
+			errs = append(errs, fmt.Sprintf("%s is required", name))
+			return false
+		}
+		return true
+	}
+	domain := func(name, value string) {
+		errs = append(errs, validateDomain(name, value)...)
+	}
+
+	if required("domain (OAUTH2_PROXY_DOMAIN)", cfg.Domain) {
+		domain("domain", cfg.Domain)
+	}
+	required("cookie-salt (COOKIE_SALT)", cfg.CookieSalt)
+	required("client-id (OAUTH2_PROXY_CLIENT_ID)", cfg.ClientID)
+	required("client-secret (OAUTH2_PROXY_CLIENT_SECRET)", cfg.ClientSecret)
+	if len(cfg.CookieDomain) != 0 {
+		domain("cookie-domain", cfg.CookieDomain)
+	}
+	if len(cfg.WhitelistDomain) != 0 {
+		for _, d := range strings.Split(cfg.WhitelistDomain, ",") {
+			domain("whitelist-domain", d)
+		}
+	}
+	if cfg.Provider != "github" {
+		errs = append(errs, fmt.Sprintf("provider %q is unknown: must be github", cfg.Provider))
+	}
+	if _, err := lookupRelease(cfg.Version); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := validateImageRepository("image", cfg.Image); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if cfg.IngressMode != IngressModeShared && cfg.IngressMode != IngressModePerApp {
+		errs = append(errs, fmt.Sprintf("ingress-mode %q is invalid: must be %s or %s", cfg.IngressMode, IngressModeShared, IngressModePerApp))
+	}
+	for _, controller := range cfg.ingressControllers() {
+		if lookupIngressAdapter(controller) == nil {
+			errs = append(errs, fmt.Sprintf("ingress-controllers %q is unknown: must be %s, %s or %s", controller, IngressControllerNginx, IngressControllerTraefik, IngressControllerHAProxy))
+		}
+	}
+	if len(cfg.TLSHosts) != 0 {
+		if len(cfg.TLSSecretName) == 0 {
+			errs = append(errs, "tls-secret-name is required with tls-hosts")
+		}
+		for _, host := range strings.Split(cfg.TLSHosts, ",") {
+			if strings.HasPrefix(host, "*.") {
+				for _, msg := range validation.IsWildcardDNS1123Subdomain(host) {
+					errs = append(errs, fmt.Sprintf("tls-hosts %q is invalid: %s", host, msg))
+				}
+			} else {
+				domain("tls-hosts", host)
+			}
+		}
+	}
+	if len(cfg.ClusterIssuer) != 0 && len(cfg.Issuer) != 0 {
+		errs = append(errs, "cert-manager-cluster-issuer and cert-manager-issuer are exclusive")
+	}
+	if len(cfg.Gateway) != 0 {
+		if _, _, err := parseGateway(cfg.Gateway); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	for _, namespace := range cfg.watchNamespaces() {
+		for _, msg := range validation.IsDNS1123Label(namespace) {
+			errs = append(errs, fmt.Sprintf("watch-namespaces %q is invalid: %s", namespace, msg))
+		}
+	}
+	if _, err := labels.Parse(cfg.IngressSelector); err != nil {
+		errs = append(errs, fmt.Sprintf("ingress-selector %q is invalid: %s", cfg.IngressSelector, err))
+	}
+	if _, err := labels.Parse(cfg.NamespaceSelector); err != nil {
+		errs = append(errs, fmt.Sprintf("namespace-selector %q is invalid: %s", cfg.NamespaceSelector, err))
+	}
+	if len(cfg.WebhookAddr) != 0 {
+		required("webhook-tls-cert-file (WEBHOOK_TLS_CERT_FILE)", cfg.WebhookCertFile)
+		required("webhook-tls-key-file (WEBHOOK_TLS_KEY_FILE)", cfg.WebhookKeyFile)
+	}
+	if period, err := time.ParseDuration(cfg.ResyncPeriod); err != nil || period < 0 {
+		errs = append(errs, fmt.Sprintf("resync-period %q is invalid: must be a duration like 10m, or 0", cfg.ResyncPeriod))
+	}
+	for _, msg := range validation.IsDNS1123Subdomain(cfg.AnnotationPrefix) {
+		errs = append(errs, fmt.Sprintf("annotation-prefix %q is invalid: %s", cfg.AnnotationPrefix, msg))
+	}
+	if len(cfg.Instance) != 0 {
+		for _, msg := range validation.IsDNS1123Label(cfg.Instance) {
+			errs = append(errs, fmt.Sprintf("instance %q is invalid: %s", cfg.Instance, msg))
+		}
+	}
+
+	known := map[string]bool{}
+	for _, key := range proxyOptionKeys {
+		known[key] = true
+	}
+	keys := []string{}
+	for key := range cfg.Proxy {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !known[key] {
+			errs = append(errs, fmt.Sprintf("proxy option %q is unknown", key))
+		}
+	}
+	proxy, proxyErrs := parseProxyOption(mapLookup(cfg.Proxy))
+	for _, err := range proxyErrs {
+		errs = append(errs, err.Error())
+	}
+	if release, err := lookupRelease(cfg.Version); err == nil && proxy.Sharing == ProxySharingPerOrg && !release.AllowedGroups {
+		errs = append(errs, fmt.Sprintf("sharing %s needs allowed_groups of oauth2_proxy v7 or later, got version %q", ProxySharingPerOrg, cfg.Version))
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// resyncPeriod - ResyncPeriod as duration. Invalid value disables resync, rejected by Validate.
+func (cfg *Config) resyncPeriod() time.Duration {
+	period, err := time.ParseDuration(cfg.ResyncPeriod)
+	if err != nil || period < 0 {
+		return 0
+	}
+	return period
+}
+
+// watchNamespaces - Namespaces to observe. Empty means all namespaces.
+func (cfg *Config) watchNamespaces() []string {
+	namespaces := []string{}
+	for _, namespace := range strings.Split(cfg.WatchNamespaces, ",") {
+		if namespace = strings.TrimSpace(namespace); len(namespace) != 0 {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces
+}
+
+// ingressControllers - Ingress controllers of protected Ingresses. nginx if not set.
+func (cfg *Config) ingressControllers() []string {
+	controllers := []string{}
+	for _, controller := range strings.Split(cfg.IngressControllers, ",") {
+		if controller = strings.TrimSpace(controller); len(controller) != 0 {
+			controllers = append(controllers, controller)
+		}
+	}
+	if len(controllers) == 0 {
+		return []string{IngressControllerNginx}
+	}
+	return controllers
+}
+
+// mapLookup - Find a value in map (Config.Proxy)
+func mapLookup(values map[string]string) lookupFunc {
+	return func(key string) (string, bool) {
+		value, ok := values[key]
+		return value, ok
+	}
+}
+
+// parseProxyOption - Parse defaults of generated oauth2_proxy. Returns every error.
+func parseProxyOption(lookup lookupFunc) (ProxyOption, []error) {
+	option := ProxyOption{
+		RunAsUser:   DefaultRunAsUser,
+		ServiceType: ServiceTypeClusterIP,
+		RedisImage:  DefaultRedisImage,
+	}
+	errs := []error{}
+
+	deployment, err := parseDeploymentSettings(lookup)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	option.Deployment = deployment
+
+	if value, ok := lookup("run-as-user"); ok {
+		uid, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || uid <= 0 {
+			errs = append(errs, fmt.Errorf("run-as-user %q is invalid: must be non-root uid", value))
+		} else {
+			option.RunAsUser = uid
+		}
+	}
+
+	if value, ok := lookup("service-type"); ok {
+		serviceType, err := parseServiceType(value)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			option.ServiceType = serviceType
+		}
+	}
+
+	session, err := parseSessionStoreSettings(lookup)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	option.SessionStore = session
+
+	managedRedis, err := lookupBool(lookup, "managed-redis")
+	if err != nil {
+		errs = append(errs, err)
+	}
+	option.ManagedRedis = managedRedis != nil && *managedRedis
+	if value, ok := lookup("redis-image"); ok {
+		option.RedisImage = value
+	}
+
+	if value, ok := lookup("sharing"); ok {
+		sharing, err := parseProxySharing(value)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			option.Sharing = sharing
+		}
+	}
+
+	return option, errs
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// envLookup - lookupEnv of LoadConfig reading env instead of environment variables
+func envLookup(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+// writeConfigFile - YAML configuration file removed at the end of the test
+func writeConfigFile(t *testing.T, data string) string {
+	file, err := ioutil.TempFile("", "oauth2-proxy-manager-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	filename := writeConfigFile(t, `
+domain: file.example.com
+cookieSalt: file-salt
+clientID: file-id
+clientSecret: file-secret
+proxy:
+  replicas: "1"
+  cpu-request: 100m
+`)
+	defer os.Remove(filename)
+
+	env := map[string]string{
+		"OAUTH2_PROXY_DOMAIN":        "env.example.com",
+		"OAUTH2_PROXY_CLIENT_ID":     "env-id",
+		"OAUTH2_PROXY_CLIENT_SECRET": "",
+		"OAUTH2_PROXY_REPLICAS":      "2",
+		"DRY_RUN":                    "true",
+	}
+	args := []string{"--config", filename, "--client-id", "flag-id", "--proxy-option", "replicas=3"}
+	cfg, err := LoadConfig(args, envLookup(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, field := range []struct {
+		name, got, want string
+	}{
+		{"domain (env over file)", cfg.Domain, "env.example.com"},
+		{"cookie-salt (file)", cfg.CookieSalt, "file-salt"},
+		{"client-id (flag over env)", cfg.ClientID, "flag-id"},
+		{"client-secret (empty env is unset)", cfg.ClientSecret, "file-secret"},
+		{"replicas (flag over env over file)", cfg.Proxy["replicas"], "3"},
+		{"cpu-request (file)", cfg.Proxy["cpu-request"], "100m"},
+		{"provider (default)", cfg.Provider, "github"},
+		{"version (default)", cfg.Version, DefaultProxyVersion},
+		{"annotation-prefix (default)", cfg.AnnotationPrefix, DefaultAnnotationPrefix},
+	} {
+		if field.got != field.want {
+			t.Errorf("%s = %q, want %q", field.name, field.got, field.want)
+		}
+	}
+	if !cfg.DryRun {
+		t.Error("dry-run should be read from DRY_RUN")
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+
+	// --dry-run=false wins over DRY_RUN
+	cfg, err = LoadConfig(append(args, "--dry-run=false"), envLookup(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DryRun {
+		t.Error("--dry-run=false should win over DRY_RUN")
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	filename := writeConfigFile(t, "domain: [\n")
+	defer os.Remove(filename)
+	if _, err := LoadConfig([]string{"--config", filename}, envLookup(nil)); err == nil || !strings.Contains(err.Error(), filename) {
+		t.Errorf("invalid YAML should be reported with the file, got %v", err)
+	}
+	if _, err := LoadConfig(nil, envLookup(map[string]string{"DRY_RUN": "yes please"})); err == nil || !strings.Contains(err.Error(), "DRY_RUN") {
+		t.Errorf("invalid DRY_RUN should be reported, got %v", err)
+	}
+	if _, err := LoadConfig([]string{"--proxy-option", "replicas"}, envLookup(nil)); err == nil {
+		t.Error("--proxy-option without value should be refused")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if err := newTestConfig().Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+
+	cfg := &Config{
+		Domain:           "auth_example.com",
+		CookieDomain:     ".example..com",
+		Provider:         "gitlab",
+		Version:          "v99.0.0",
+		IngressMode:      "per-host",
+		TLSHosts:         "auth.example.com",
+		ClusterIssuer:    "letsencrypt",
+		Issuer:           "letsencrypt",
+		ResyncPeriod:     "sometimes",
+		AnnotationPrefix: DefaultAnnotationPrefix,
+		Proxy:            map[string]string{"replica": "2", "cpu-request": "a lot"},
+	}
+	err := cfg.Validate()
+	errs, ok := err.(ConfigError)
+	if !ok {
+		t.Fatalf("Validate() = %v, want ConfigError", err)
+	}
+	// Every problem is reported at once
+	for _, want := range []string{
+		`domain "auth_example.com" is invalid`,
+		"cookie-salt (COOKIE_SALT) is required",
+		"client-id (OAUTH2_PROXY_CLIENT_ID) is required",
+		"client-secret (OAUTH2_PROXY_CLIENT_SECRET) is required",
+		`cookie-domain ".example..com" is invalid`,
+		`provider "gitlab" is unknown`,
+		`unsupported oauth2_proxy version "v99.0.0"`,
+		`ingress-mode "per-host" is invalid`,
+		"tls-secret-name is required with tls-hosts",
+		"cert-manager-cluster-issuer and cert-manager-issuer are exclusive",
+		`resync-period "sometimes" is invalid`,
+		`proxy option "replica" is unknown`,
+		"cpu-request",
+	} {
+		found := false
+		for _, msg := range errs {
+			if strings.Contains(msg, want) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("errors should contain %q, got:\n%s", want, err)
+		}
+	}
+}
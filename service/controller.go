@@ -3,25 +3,49 @@ package service
 import (
 	"crypto/sha256"
 	"fmt"
-	"os"
+	"reflect"
 	"strings"
+	"sync"
+	"time"
 
 	appsv1beta2 "k8s.io/api/apps/v1beta2"
 	apiv1 "k8s.io/api/core/v1"
-	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/api/extensions/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 
 	"github.com/Laica-Lunasys/oauth2-proxy-manager/models"
 	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 )
 
 type Controller struct {
-	Clientset *kubernetes.Clientset
+	Clientset kubernetes.Interface
 	Env       OAuth2ProxyEnv
 	Ingress   IngressOption
+	Proxy     ProxyOption
+
+	// Dynamic - Client of custom resources (Traefik Middlewares). nil if not available.
+	Dynamic dynamic.Interface
+
+	// DryRun - Log changes instead of writing them
+	DryRun bool
+
+	// Instance - Identity of this manager (annotation prefix / object names / labels)
+	Instance InstanceOption
+
+	// mu - Serializes Apply / Delete / Reload
+	mu     sync.Mutex
+	report dryRunReport
+	// settingsMu - Guards Env / Ingress / Proxy replaced by Reload, for readers not waiting for Apply (webhook)
+	settingsMu sync.RWMutex
+	// sidecars - "<namespace>/<name>" of Secrets / ConfigMaps applied for sidecars => last injection
+	sidecars map[string]time.Time
+	// apps - Apps applied and not deleted since start, by proxyName. Shared objects (oauth2_proxy shared per org, managed Redis) are kept while an app here uses them.
+	apps map[string]*models.ServiceSettings
 }
 
 type OAuth2ProxyEnv struct {
@@ -32,62 +56,364 @@ type OAuth2ProxyEnv struct {
 	Provider        string
 	ClientID        string
 	ClientSecret    string
+	Image           string
+	Version         string
 }
 
 type IngressOption struct {
 	TLSSecretName string
 	TLSHosts      string
 	IngressClass  string
+	Mode          string
+	ClusterIssuer string
+	Issuer        string
+	// Gateway - Gateway serving oauth2_proxy by HTTPRoute ("<namespace>/<name>"). Empty uses Ingress.
+	Gateway string
+}
+
+// ProxyOption - Defaults of generated oauth2_proxy Deployment / Service
+type ProxyOption struct {
+	Deployment   models.DeploymentSettings
+	RunAsUser    int64
+	ServiceType  string
+	SessionStore models.SessionStoreSettings
+	ManagedRedis bool
+	RedisImage   string
+	// Sharing - Sharing of oauth2_proxy between apps (per-app / per-org)
+	Sharing string
+}
+
+// proxySpec - Settings of the app resolved with global defaults
+type proxySpec struct {
+	Release         proxyRelease
+	Deployment      models.DeploymentSettings
+	SessionStore    models.SessionStoreSettings
+	AuthHost        string
+	CookieDomain    string
+	WhitelistDomain string
 }
 
-func makeController(clientset *kubernetes.Clientset) *Controller {
+// Service types of generated oauth2_proxy Service
+const (
+	ServiceTypeClusterIP = "ClusterIP"
+	ServiceTypeNodePort  = "NodePort"
+	ServiceTypeHeadless  = "Headless"
+)
+
+// parseServiceType - Normalize service type ("clusterip" => "ClusterIP")
+func parseServiceType(value string) (string, error) {
+	for _, serviceType := range []string{ServiceTypeClusterIP, ServiceTypeNodePort, ServiceTypeHeadless} {
+		if strings.EqualFold(value, serviceType) {
+			return serviceType, nil
+		}
+	}
+	return "", fmt.Errorf("service-type %q is invalid: must be ClusterIP, NodePort or Headless", value)
+}
+
+func makeController(clientset kubernetes.Interface, cfg *Config) *Controller {
+	proxy, _ := parseProxyOption(mapLookup(cfg.Proxy))
 	return &Controller{
 		Clientset: clientset,
 		Env: OAuth2ProxyEnv{
-			Domain:          os.Getenv("OAUTH2_PROXY_DOMAIN"),
-			CookieDomain:    os.Getenv("COOKIE_DOMAIN"),
-			CookieSalt:      os.Getenv("COOKIE_SALT"),
-			WhitelistDomain: os.Getenv("WHITELIST_DOMAIN"),
-			Provider:        os.Getenv("PROVIDER"),
-			ClientID:        os.Getenv("OAUTH2_PROXY_CLIENT_ID"),
-			ClientSecret:    os.Getenv("OAUTH2_PROXY_CLIENT_SECRET"),
+			Domain:          cfg.Domain,
+			CookieDomain:    cfg.CookieDomain,
+			CookieSalt:      cfg.CookieSalt,
+			WhitelistDomain: cfg.WhitelistDomain,
+			Provider:        cfg.Provider,
+			ClientID:        cfg.ClientID,
+			ClientSecret:    cfg.ClientSecret,
+			Image:           cfg.Image,
+			Version:         cfg.Version,
 		},
 		Ingress: IngressOption{
-			IngressClass:  os.Getenv("INGRESS_CLASS"),
-			TLSSecretName: os.Getenv("TLS_SECRET_NAME"),
-			TLSHosts:      os.Getenv("TLS_HOSTS"),
+			IngressClass:  cfg.IngressClass,
+			TLSSecretName: cfg.TLSSecretName,
+			TLSHosts:      cfg.TLSHosts,
+			Mode:          cfg.IngressMode,
+			ClusterIssuer: cfg.ClusterIssuer,
+			Issuer:        cfg.Issuer,
+			Gateway:       cfg.Gateway,
+		},
+		Proxy:  proxy,
+		DryRun: cfg.DryRun,
+		Instance: InstanceOption{
+			Name:               cfg.Instance,
+			AnnotationPrefix:   cfg.AnnotationPrefix,
+			IngressControllers: cfg.ingressControllers(),
 		},
 	}
 }
 
-func NewController(clientset *kubernetes.Clientset) (*Controller, error) {
-	// TODO: Handle error while extract Environment Variables...
-	c := makeController(clientset)
-	return c, nil
+func NewController(clientset kubernetes.Interface, cfg *Config) (*Controller, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return makeController(clientset, cfg), nil
 }
 
-func (c *Controller) Apply(settings *models.ServiceSettings) {
+// Reload - Replace global settings with cfg. Returns whether anything changed.
+func (c *Controller) Reload(cfg *Config) (bool, error) {
+	if err := cfg.Validate(); err != nil {
+		return false, err
+	}
+	next := makeController(c.Clientset, cfg)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if reflect.DeepEqual(c.Env, next.Env) && reflect.DeepEqual(c.Ingress, next.Ingress) && reflect.DeepEqual(c.Proxy, next.Proxy) {
+		return false, nil
+	}
+	c.settingsMu.Lock()
+	defer c.settingsMu.Unlock()
+	c.Env = next.Env
+	c.Ingress = next.Ingress
+	c.Proxy = next.Proxy
+	return true, nil
+}
+
+// Apply - Create or update oauth2_proxy of the app. Error is returned when settings can't be resolved; nothing is applied then.
+func (c *Controller) Apply(settings *models.ServiceSettings) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.report = dryRunReport{}
+	defer c.logDryRunReport(settings)
+	return c.apply(settings)
+}
+
+// ApplyIngress - Apply the app of source, and Ingress of its public paths, as one change (one report in dry-run mode)
+func (c *Controller) ApplyIngress(source *v1beta1.Ingress, settings *models.ServiceSettings) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.report = dryRunReport{}
+	defer c.logDryRunReport(settings)
+	if err := c.apply(settings); err != nil {
+		return err
+	}
+	c.applyPublicIngress(source, settings)
+	return nil
+}
+
+func (c *Controller) apply(settings *models.ServiceSettings) error {
 	logrus.Infof("[Controller] Applying oauth2_proxy(%s)...", settings.AppName)
-	c.applyService(settings)
-	c.applySecret(settings)
-	c.applyConfigMap(settings)
-	c.applyDeployment(settings)
-	c.applyIngress(settings)
+	spec, err := c.resolve(settings)
+	if err != nil {
+		logrus.Errorf("[Controller] Skip oauth2_proxy(%s): %s", settings.AppName, err)
+		return err
+	}
+	if c.apps == nil {
+		c.apps = map[string]*models.ServiceSettings{}
+	}
+	c.apps[proxyName(settings)] = settings
+
+	if spec.SessionStore.RedisSecretName == c.managedRedisName() {
+		c.applyManagedRedis()
+	}
+	proxy := c.servingProxy(settings)
+	c.applyService(proxy)
+	c.applySecret("oauth2-proxy", proxy, spec)
+	c.applyConfigMap("oauth2-proxy", proxy)
+	c.applyDeployment(proxy, spec)
+	c.applyPodDisruptionBudget(proxy, spec.Deployment)
+	c.applyHorizontalPodAutoscaler(proxy, spec.Deployment)
+	c.applyIngress(proxy)
+
+	if proxy != settings {
+		// Migrate from oauth2_proxy of the app
+		c.joinSharedProxy(settings)
+		c.deleteProxy(settings)
+	} else {
+		// Migrate from oauth2_proxy shared by the org
+		c.leaveSharedProxy(settings)
+	}
+	c.releaseManagedRedis()
+	return nil
+}
+
+// resolve - Resolve settings of oauth2_proxy serving the app with global defaults
+func (c *Controller) resolve(settings *models.ServiceSettings) (proxySpec, error) {
+	shared := c.proxySharing(settings) == ProxySharingPerOrg
+	if shared {
+		if conflicts := sharedProxyConflicts(settings); len(conflicts) != 0 {
+			return proxySpec{}, fmt.Errorf("%s can't be set for oauth2_proxy shared per org (use sharing: %s)", strings.Join(conflicts, ", "), ProxySharingPerApp)
+		}
+		settings = orgProxy(settings)
+	}
+	release, err := lookupRelease(c.proxyVersion(settings))
+	if err != nil {
+		return proxySpec{}, err
+	}
+	if shared && !release.AllowedGroups {
+		return proxySpec{}, fmt.Errorf("oauth2_proxy shared per org needs allowed_groups of oauth2_proxy v7 or later, got %q", c.proxyVersion(settings))
+	}
+	session, err := c.resolveSessionStore(settings, release)
+	if err != nil {
+		return proxySpec{}, err
+	}
+	deployment := mergeDeploymentSettings(c.Proxy.Deployment, settings.Deployment)
+	if err := validateDeploymentSettings(deployment); err != nil {
+		return proxySpec{}, err
+	}
+	spec := proxySpec{
+		Release:         release,
+		Deployment:      deployment,
+		SessionStore:    session,
+		AuthHost:        c.authHost(settings),
+		CookieDomain:    c.Env.CookieDomain,
+		WhitelistDomain: c.Env.WhitelistDomain,
+	}
+	if len(settings.CookieDomain) != 0 {
+		spec.CookieDomain = settings.CookieDomain
+	}
+	if len(settings.WhitelistDomain) != 0 {
+		spec.WhitelistDomain = settings.WhitelistDomain
+	}
+	return spec, nil
+}
+
+// proxyVersion - oauth2_proxy version for the app (annotation > global)
+func (c *Controller) proxyVersion(settings *models.ServiceSettings) string {
+	if len(settings.Version) != 0 {
+		return settings.Version
+	}
+	return c.Env.Version
+}
+
+// proxyImage - oauth2_proxy image for the app (annotation > global > repository of the release line)
+func (c *Controller) proxyImage(settings *models.ServiceSettings, release proxyRelease) string {
+	repository := release.Repository
+	if len(settings.Image) != 0 {
+		repository = settings.Image
+	} else if len(c.Env.Image) != 0 {
+		repository = c.Env.Image
+	}
+	return fmt.Sprintf("%s:%s", repository, c.proxyVersion(settings))
 }
 
 func (c *Controller) Delete(settings *models.ServiceSettings) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.report = dryRunReport{}
+	defer c.logDryRunReport(settings)
+
 	logrus.Infof("[Controller] Delete oauth2_proxy(%s)", settings.AppName)
+	delete(c.apps, proxyName(settings))
+	c.deleteProxy(settings)
+	c.leaveSharedProxy(settings)
+	c.releaseManagedRedis()
 }
 
-func (c *Controller) applyService(settings *models.ServiceSettings) {
-	servicesClient := c.Clientset.CoreV1().Services("oauth2-proxy")
+// deleteProxy - Delete objects of oauth2_proxy of settings (an app, or shared by an org)
+func (c *Controller) deleteProxy(settings *models.ServiceSettings) {
+	name := proxyName(settings)
+	c.deleteIngress(settings)
+	c.deleteHTTPRoute(settings)
+	c.deleteObject("HorizontalPodAutoscaler", "oauth2-proxy", name, c.Clientset.AutoscalingV1().HorizontalPodAutoscalers("oauth2-proxy").Delete)
+	c.deleteObject("PodDisruptionBudget", "oauth2-proxy", name, c.Clientset.PolicyV1beta1().PodDisruptionBudgets("oauth2-proxy").Delete)
+	c.deleteObject("Deployment", "oauth2-proxy", name, c.Clientset.AppsV1beta2().Deployments("oauth2-proxy").Delete)
+	c.deleteObject("ConfigMap", "oauth2-proxy", name, c.Clientset.CoreV1().ConfigMaps("oauth2-proxy").Delete)
+	c.deleteObject("Secret", "oauth2-proxy", name, c.Clientset.CoreV1().Secrets("oauth2-proxy").Delete)
+	c.deleteObject("Service", "oauth2-proxy", name, c.Clientset.CoreV1().Services("oauth2-proxy").Delete)
+}
+
+// proxyName - Name of objects generated for the app ("oauth2-proxy-github-<org>" if shared by the org).
+// GitHub org is case-insensitive, object names are not.
+func proxyName(settings *models.ServiceSettings) string {
+	prefix := InstanceOption{Name: settings.Instance}.objectName("oauth2-proxy")
+	if len(settings.AppName) == 0 {
+		return fmt.Sprintf("%s-github-%s", prefix, strings.ToLower(settings.GitHub.Organization))
+	}
+	return fmt.Sprintf("%s-github-%s-%s", prefix, strings.ToLower(settings.GitHub.Organization), settings.AppName)
+}
+
+// proxyPath - Path of oauth2_proxy on auth host ("/github/<app>", or "/github-org/<org>" if shared by the org)
+func proxyPath(settings *models.ServiceSettings) string {
+	// Instances serving the same host never route the same path
+	instance := InstanceOption{Name: settings.Instance}
+	if len(settings.AppName) == 0 {
+		return "/" + instance.objectName("github-org") + "/" + strings.ToLower(settings.GitHub.Organization)
+	}
+	return "/" + instance.objectName("github") + "/" + settings.AppName
+}
+
+// cookieName - Name of session cookie. Distinct per instance, so that instances on a domain don't share sessions.
+func cookieName(settings *models.ServiceSettings) string {
+	name := settings.GitHub.Organization
+	if len(settings.AppName) != 0 {
+		name += "_" + settings.AppName
+	}
+	if len(settings.Instance) == 0 {
+		return fmt.Sprintf("_github_%s_oauth2_proxy", name)
+	}
+	return fmt.Sprintf("_github_%s_%s_oauth2_proxy", settings.Instance, name)
+}
+
+// cookieSecretKey - Key of cookie secret in the Secret of the app
+func (c *Controller) cookieSecretKey(settings *models.ServiceSettings) string {
+	if len(settings.AppName) == 0 {
+		return fmt.Sprintf("%s-%s-cookie-secret", c.Env.Provider, settings.GitHub.Organization)
+	}
+	return fmt.Sprintf("%s-%s-%s-cookie-secret", c.Env.Provider, settings.GitHub.Organization, settings.AppName)
+}
+
+// deleteObject - Delete generated object. Already deleted object is ignored.
+// In dry-run mode, API server checks the deletion without persisting it.
+func (c *Controller) deleteObject(kind string, namespace string, name string, del func(name string, options *metav1.DeleteOptions) error) {
+	if err := c.deleteObjectAt(kind, namespace, name, "", del); err != nil {
+		logrus.Panic(err)
+	}
+}
+
+// deleteObjectAt - Delete the object only if it's still at resourceVersion (any version if empty).
+// Conflict is returned, so that the caller can read it again.
+func (c *Controller) deleteObjectAt(kind string, namespace string, name string, resourceVersion string, del func(name string, options *metav1.DeleteOptions) error) error {
+	if c.DryRun {
+		// Read instead of deleting: nothing is deleted even if DryRun of DeleteOptions is ignored
+		exists, err := c.objectExists(kind, namespace, name)
+		if err != nil || !exists {
+			return err
+		}
+		c.report.Delete++
+		logrus.Infof("[dry-run] Would delete %s %s/%s", kind, namespace, name)
+		return nil
+	}
+
+	propagation := metav1.DeletePropagationBackground
+	options := &metav1.DeleteOptions{PropagationPolicy: &propagation}
+	if len(resourceVersion) != 0 {
+		options.Preconditions = &metav1.Preconditions{ResourceVersion: &resourceVersion}
+	}
+	err := del(name, options)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	logrus.Printf("[oauth2_proxy] Deleted %s! %q", kind, name)
+	return nil
+}
+
+// logDryRunReport - Summary of changes for the app in dry-run mode
+func (c *Controller) logDryRunReport(settings *models.ServiceSettings) {
+	if c.DryRun {
+		logrus.Infof("[dry-run] oauth2_proxy(%s): %s", settings.AppName, c.report)
+	}
+}
+
+// newService - Service of the app
+func (c *Controller) newService(settings *models.ServiceSettings) *apiv1.Service {
+	serviceType := c.Proxy.ServiceType
+	if len(settings.ServiceType) != 0 {
+		serviceType = settings.ServiceType
+	}
 	service := &apiv1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      fmt.Sprintf("oauth2-proxy-github-%s-%s", settings.GitHub.Organization, settings.AppName),
+			Name:      proxyName(settings),
 			Namespace: "oauth2-proxy",
+			Labels:    c.Instance.labels(),
 		},
 		Spec: apiv1.ServiceSpec{
-			Type: apiv1.ServiceTypeNodePort,
+			Type: apiv1.ServiceTypeClusterIP,
 			Ports: []apiv1.ServicePort{
 				apiv1.ServicePort{
 					Name:       "http",
@@ -97,27 +423,72 @@ func (c *Controller) applyService(settings *models.ServiceSettings) {
 				},
 			},
 			Selector: map[string]string{
-				"app": fmt.Sprintf("oauth2-proxy-github-%s-%s", settings.GitHub.Organization, settings.AppName),
+				"app": proxyName(settings),
 			},
 		},
 	}
+	switch serviceType {
+	case ServiceTypeNodePort:
+		service.Spec.Type = apiv1.ServiceTypeNodePort
+	case ServiceTypeHeadless:
+		service.Spec.ClusterIP = apiv1.ClusterIPNone
+	}
+	return service
+}
+
+func (c *Controller) applyService(settings *models.ServiceSettings) {
+	servicesClient := c.Clientset.CoreV1().Services("oauth2-proxy")
+	service := c.newService(settings)
+
 	logrus.Printf("[oauth2_proxy] Check Service...")
-	result, err := servicesClient.Get(fmt.Sprintf("oauth2-proxy-github-%s-%s", settings.GitHub.Organization, settings.AppName), metav1.GetOptions{})
-	if len(result.GetName()) == 0 {
-		// NotFound
+	result, err := servicesClient.Get(proxyName(settings), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		logrus.Panic(err)
+	}
+	if apierrors.IsNotFound(err) {
+		if c.dryRun("Service", nil, service) {
+			return
+		}
 		logrus.Printf("[oauth2_proxy] Creating Service...")
 		result, err = servicesClient.Create(service)
 		if err != nil {
 			logrus.Panic(err)
 		}
 		logrus.Printf("[oauth2_proxy] Created Service! %q", result.GetObjectMeta().GetName())
+	} else if (result.Spec.ClusterIP == apiv1.ClusterIPNone) != (service.Spec.ClusterIP == apiv1.ClusterIPNone) {
+		// ClusterIP is immutable: switching from / to headless needs recreation
+		if c.dryRun("Service", result, service) {
+			return
+		}
+		logrus.Printf("[oauth2_proxy] Recreate Service...")
+		c.deleteObject("Service", "oauth2-proxy", result.GetName(), servicesClient.Delete)
+		result, err = servicesClient.Create(service)
+		if err != nil {
+			logrus.Panic(err)
+		}
+		logrus.Printf("[oauth2_proxy] Created Service! %q", result.GetObjectMeta().GetName())
 	} else {
+		if c.dryRun("Service", result, service) {
+			return
+		}
 		logrus.Printf("[oauth2_proxy] Update Service...")
 
 		// Inject ClusterIP
 		logrus.Debugf("[oauth2_proxy] Detected ClusterIP: %s", result.Spec.ClusterIP)
 		service.Spec.ClusterIP = result.Spec.ClusterIP
 
+		// Inject NodePort (keep allocated ports while staying NodePort)
+		if service.Spec.Type == apiv1.ServiceTypeNodePort {
+			for i, port := range service.Spec.Ports {
+				for _, existPort := range result.Spec.Ports {
+					if existPort.Name == port.Name && existPort.NodePort != 0 {
+						logrus.Debugf("[oauth2_proxy] Detected NodePort(%s): %d", existPort.Name, existPort.NodePort)
+						service.Spec.Ports[i].NodePort = existPort.NodePort
+					}
+				}
+			}
+		}
+
 		// Inject ResourceVersion
 		logrus.Debugf("[oauth2_proxy] Detected ResourceVersion: %s", result.GetResourceVersion())
 		service.SetResourceVersion(result.GetResourceVersion())
@@ -130,288 +501,317 @@ func (c *Controller) applyService(settings *models.ServiceSettings) {
 
 }
 
-func (c *Controller) applyIngress(settings *models.ServiceSettings) {
-	ingressClient := c.Clientset.ExtensionsV1beta1().Ingresses("oauth2-proxy")
-	ingress := &extensionsv1beta1.Ingress{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      "oauth2-proxy",
-			Namespace: "oauth2-proxy",
-			Annotations: map[string]string{
-				"kubernetes.io/ingress.class": "nginx",
-			},
-		},
-		Spec: extensionsv1beta1.IngressSpec{
-			Rules: []extensionsv1beta1.IngressRule{
-				extensionsv1beta1.IngressRule{
-					Host: c.Env.Domain,
-					IngressRuleValue: extensionsv1beta1.IngressRuleValue{
-						HTTP: &extensionsv1beta1.HTTPIngressRuleValue{
-							Paths: []extensionsv1beta1.HTTPIngressPath{
-								extensionsv1beta1.HTTPIngressPath{
-									Path: fmt.Sprintf("/github/%s", settings.AppName),
-									Backend: extensionsv1beta1.IngressBackend{
-										ServiceName: fmt.Sprintf("oauth2-proxy-%s-%s-%s", c.Env.Provider, settings.GitHub.Organization, settings.AppName),
-										ServicePort: intstr.FromInt(80),
-									},
-								},
-							},
-						},
-					},
-				},
-			},
-		},
-	}
-
-	if len(c.Ingress.IngressClass) != 0 {
-		ingress.Annotations["kubernetes.io/ingress.class"] = c.Ingress.IngressClass
-	}
-
-	if len(c.Ingress.TLSHosts) != 0 && len(c.Ingress.TLSSecretName) != 0 {
-		ingress.Spec.TLS = []extensionsv1beta1.IngressTLS{
-			extensionsv1beta1.IngressTLS{
-				Hosts:      strings.Split(c.Ingress.TLSHosts, ","),
-				SecretName: c.Ingress.TLSSecretName,
-			},
-		}
-	}
-
-	result, err := ingressClient.Get("oauth2-proxy", metav1.GetOptions{})
-	if len(result.GetName()) == 0 {
-		// NotFound
-		logrus.Printf("[oauth2_proxy] Creating Ingress...")
-
-		result, err = ingressClient.Create(ingress)
-		if err != nil {
-			logrus.Panic(err)
-		}
-		logrus.Printf("[oauth2_proxy] Created Ingress! %q", result.GetObjectMeta().GetName())
-	} else {
-		logrus.Printf("[oauth2_proxy] Update Ingress...")
-
-		// Append New Entry
-		for _, existPath := range result.Spec.Rules[0].IngressRuleValue.HTTP.Paths {
-			if existPath.Path != ingress.Spec.Rules[0].IngressRuleValue.HTTP.Paths[0].Path {
-				ingress.Spec.Rules[0].IngressRuleValue.HTTP.Paths = append(ingress.Spec.Rules[0].IngressRuleValue.HTTP.Paths, existPath)
-			}
-		}
-
-		result, err = ingressClient.Update(ingress)
-		if err != nil {
-			logrus.Panic(err)
-		}
-		logrus.Printf("[oauth2_proxy] Updated Ingress! %q", result.GetObjectMeta().GetName())
-	}
-}
-
-func (c *Controller) applySecret(settings *models.ServiceSettings) {
-	secretClient := c.Clientset.CoreV1().Secrets("oauth2-proxy")
+// newSecret - Secret of the app (client credentials, cookie secret) in namespace
+func (c *Controller) newSecret(namespace string, settings *models.ServiceSettings, spec proxySpec) *apiv1.Secret {
 	cookieSecret := fmt.Sprintf("%x", sha256.Sum256([]byte(
 		c.Env.Provider+
 			settings.GitHub.Organization+
 			strings.Join(settings.GitHub.Teams, "")+
 			settings.AppName+c.Env.CookieSalt,
 	)))
+	if spec.Release.CookieSecretLength != 0 {
+		// Newer oauth2_proxy uses cookie secret as AES key
+		cookieSecret = cookieSecret[:spec.Release.CookieSecretLength]
+	}
 	secret := &apiv1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      fmt.Sprintf("oauth2-proxy-github-%s-%s", settings.GitHub.Organization, settings.AppName),
-			Namespace: "oauth2-proxy",
+			Name:      proxyName(settings),
+			Namespace: namespace,
+			Labels:    c.Instance.labels(),
 		},
 		Type: apiv1.SecretTypeOpaque,
 		StringData: map[string]string{
-			fmt.Sprintf("%s-%s-%s-cookie-secret", c.Env.Provider, settings.GitHub.Organization, settings.AppName): cookieSecret,
-			"client-secret": c.Env.ClientSecret,
-			"client-id":     c.Env.ClientID,
+			c.cookieSecretKey(settings): cookieSecret,
+			"client-secret":             c.Env.ClientSecret,
+			"client-id":                 c.Env.ClientID,
 		},
 	}
+	return secret
+}
+
+func (c *Controller) applySecret(namespace string, settings *models.ServiceSettings, spec proxySpec) {
+	if err := c.applySecretObject(c.newSecret(namespace, settings, spec)); err != nil {
+		logrus.Panic(err)
+	}
+}
+
+// applySecretObject - Create or update the Secret. Errors are returned, for callers which must not panic (webhook).
+func (c *Controller) applySecretObject(secret *apiv1.Secret) error {
+	secretClient := c.Clientset.CoreV1().Secrets(secret.Namespace)
+
 	logrus.Printf("[oauth2_proxy] Check Secret...")
-	result, err := secretClient.Get(fmt.Sprintf("oauth2-proxy-github-%s-%s", settings.GitHub.Organization, settings.AppName), metav1.GetOptions{})
-	if len(result.GetName()) == 0 {
-		// NotFound
+	result, err := secretClient.Get(secret.Name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if apierrors.IsNotFound(err) {
+		if c.dryRun("Secret", nil, secret) {
+			return nil
+		}
 		logrus.Printf("[oauth2_proxy] Creating Secret...")
 		result, err = secretClient.Create(secret)
 		if err != nil {
-			logrus.Panic(err)
+			return err
 		}
 		logrus.Printf("[oauth2_proxy] Created Secret! %q", result.GetObjectMeta().GetName())
 	} else {
+		if c.dryRun("Secret", result, secret) {
+			return nil
+		}
 		logrus.Printf("[oauth2_proxy] Update Secret...")
 		result, err = secretClient.Update(secret)
 		if err != nil {
-			logrus.Panic(err)
+			return err
 		}
 		logrus.Printf("[oauth2_proxy] Updated Secret! %q", result.GetObjectMeta().GetName())
 	}
+	return nil
 }
 
-func (c *Controller) applyConfigMap(settings *models.ServiceSettings) {
-	configMapClient := c.Clientset.CoreV1().ConfigMaps("oauth2-proxy")
+// newConfigMap - ConfigMap of the app (oauth2_proxy.cfg) in namespace
+func (c *Controller) newConfigMap(namespace string, settings *models.ServiceSettings) *apiv1.ConfigMap {
 	configMap := &apiv1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      fmt.Sprintf("oauth2-proxy-github-%s-%s", settings.GitHub.Organization, settings.AppName),
-			Namespace: "oauth2-proxy",
+			Name:      proxyName(settings),
+			Namespace: namespace,
+			Labels:    c.Instance.labels(),
 		},
 		Data: map[string]string{
 			"oauth2_proxy.cfg": "email_domains = [ \"*\" ]\nupstreams = [ \"file:///dev/null\" ]",
 		},
 	}
+	return configMap
+}
+
+func (c *Controller) applyConfigMap(namespace string, settings *models.ServiceSettings) {
+	if err := c.applyConfigMapObject(c.newConfigMap(namespace, settings)); err != nil {
+		logrus.Panic(err)
+	}
+}
+
+// applyConfigMapObject - Create or update the ConfigMap. Errors are returned, for callers which must not panic (webhook).
+func (c *Controller) applyConfigMapObject(configMap *apiv1.ConfigMap) error {
+	configMapClient := c.Clientset.CoreV1().ConfigMaps(configMap.Namespace)
+
 	logrus.Printf("[oauth2_proxy] Check ConfigMap...")
-	result, err := configMapClient.Get(fmt.Sprintf("oauth2-proxy-github-%s-%s", settings.GitHub.Organization, settings.AppName), metav1.GetOptions{})
-	if len(result.GetName()) == 0 {
-		// NotFound
+	result, err := configMapClient.Get(configMap.Name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if apierrors.IsNotFound(err) {
+		if c.dryRun("ConfigMap", nil, configMap) {
+			return nil
+		}
 		logrus.Printf("[oauth2_proxy] Creating ConfigMap...")
 		result, err = configMapClient.Create(configMap)
 		if err != nil {
-			logrus.Panic(err)
+			return err
 		}
 		logrus.Printf("[oauth2_proxy] Created ConfigMap! %q", result.GetObjectMeta().GetName())
 	} else {
+		// Keep apps of shared oauth2_proxy
+		key := c.Instance.AnnotationPrefix + "/" + sharedProxyAppsKey
+		if apps, ok := result.Annotations[key]; ok {
+			configMap.Annotations = map[string]string{key: apps}
+		}
+		if c.dryRun("ConfigMap", result, configMap) {
+			return nil
+		}
 		logrus.Printf("[oauth2_proxy] Update ConfigMap...")
 		result, err = configMapClient.Update(configMap)
 		if err != nil {
-			logrus.Panic(err)
+			return err
 		}
 		logrus.Printf("[oauth2_proxy] Updated ConfigMap! %q", result.GetObjectMeta().GetName())
 	}
+	return nil
 }
 
-func (c *Controller) applyDeployment(settings *models.ServiceSettings) {
-	deploymentsClient := c.Clientset.AppsV1beta2().Deployments("oauth2-proxy")
+// newDeployment - oauth2_proxy Deployment of the app
+func (c *Controller) newDeployment(settings *models.ServiceSettings, spec proxySpec) *appsv1beta2.Deployment {
+	tuning := spec.Deployment
+	if tuning.Replicas == nil {
+		tuning.Replicas = int32Ptr(1)
+	}
+	if autoscalingEnabled(tuning) && *tuning.Replicas < 1 {
+		// HorizontalPodAutoscaler doesn't scale Deployment of 0 replicas
+		replicas := int32(1)
+		if tuning.Autoscaling.MinReplicas != nil && *tuning.Autoscaling.MinReplicas > replicas {
+			replicas = *tuning.Autoscaling.MinReplicas
+		}
+		tuning.Replicas = &replicas
+	}
+	labels := map[string]string{
+		"app": proxyName(settings),
+	}
 	deployment := &appsv1beta2.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      fmt.Sprintf("oauth2-proxy-github-%s-%s", settings.GitHub.Organization, settings.AppName),
+			Name:      proxyName(settings),
 			Namespace: "oauth2-proxy",
+			Labels:    c.Instance.labels(),
 		},
 		Spec: appsv1beta2.DeploymentSpec{
-			Replicas: int32Ptr(1),
+			Replicas: tuning.Replicas,
 			Selector: &metav1.LabelSelector{
 				MatchLabels: map[string]string{
-					"app": fmt.Sprintf("oauth2-proxy-github-%s-%s", settings.GitHub.Organization, settings.AppName),
+					"app": proxyName(settings),
 				},
 			},
 			Template: apiv1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
 					Labels: map[string]string{
-						"app": fmt.Sprintf("oauth2-proxy-github-%s-%s", settings.GitHub.Organization, settings.AppName),
+						"app": proxyName(settings),
 					},
 				},
 				Spec: apiv1.PodSpec{
+					NodeSelector: tuning.NodeSelector,
+					Tolerations:  tuning.Tolerations,
+					Affinity:     spreadAffinity(tuning.Affinity, tuning.SpreadTopologyKey, labels),
 					Containers: []apiv1.Container{
-						apiv1.Container{
-							Name:  "oauth2-proxy",
-							Image: "quay.io/pusher/oauth2_proxy:v3.2.0",
-							Args: []string{
-								"--http-address=0.0.0.0:4180",
-								fmt.Sprintf("--cookie-domain=%s", c.Env.CookieDomain),
-								fmt.Sprintf("--cookie-name=_github_%s_%s_oauth2_proxy", settings.GitHub.Organization, settings.AppName),
-								"--email-domain=*",
-								fmt.Sprintf("--github-org=%s", settings.GitHub.Organization),
-								fmt.Sprintf("--github-team=%s", strings.Join(settings.GitHub.Teams, ",")),
-								fmt.Sprintf("--provider=github"),
-								fmt.Sprintf("--proxy-prefix=/github/%s", settings.AppName),
-								fmt.Sprintf("--redirect-url=https://%s/github/%s/callback", c.Env.Domain, settings.AppName),
-								fmt.Sprintf("--upstream=file:///dev/null"),
-								fmt.Sprintf("--whitelist-domain=%s", c.Env.WhitelistDomain),
-								fmt.Sprintf("--config=/etc/oauth2_proxy/oauth2_proxy.cfg"),
-							},
-							Env: []apiv1.EnvVar{
-								apiv1.EnvVar{
-									Name: "OAUTH2_PROXY_CLIENT_ID",
-									ValueFrom: &apiv1.EnvVarSource{
-										SecretKeyRef: &apiv1.SecretKeySelector{
-											LocalObjectReference: apiv1.LocalObjectReference{
-												Name: fmt.Sprintf("oauth2-proxy-%s-%s-%s", c.Env.Provider, settings.GitHub.Organization, settings.AppName),
-											},
-											Key: "client-id",
-										},
-									},
-								},
-								apiv1.EnvVar{
-									Name: "OAUTH2_PROXY_CLIENT_SECRET",
-									ValueFrom: &apiv1.EnvVarSource{
-										SecretKeyRef: &apiv1.SecretKeySelector{
-											LocalObjectReference: apiv1.LocalObjectReference{
-												Name: fmt.Sprintf("oauth2-proxy-%s-%s-%s", c.Env.Provider, settings.GitHub.Organization, settings.AppName),
-											},
-											Key: "client-secret",
-										},
-									},
-								},
-								apiv1.EnvVar{
-									Name: "OAUTH2_PROXY_COOKIE_SECRET",
-									ValueFrom: &apiv1.EnvVarSource{
-										SecretKeyRef: &apiv1.SecretKeySelector{
-											LocalObjectReference: apiv1.LocalObjectReference{
-												Name: fmt.Sprintf("oauth2-proxy-%s-%s-%s", c.Env.Provider, settings.GitHub.Organization, settings.AppName),
-											},
-											Key: fmt.Sprintf("%s-%s-%s-cookie-secret", c.Env.Provider, settings.GitHub.Organization, settings.AppName),
-										},
-									},
-								},
-								apiv1.EnvVar{
-									Name:  "OAUTH2_PROXY_SET_XAUTHREQUEST",
-									Value: settings.SetXAuthRequest,
-								},
-							},
-							Ports: []apiv1.ContainerPort{
-								{
-									Name:          "http",
-									Protocol:      apiv1.ProtocolTCP,
-									ContainerPort: 4180,
-								},
-							},
-							LivenessProbe: &apiv1.Probe{
-								InitialDelaySeconds: 0,
-								TimeoutSeconds:      1,
-								Handler: apiv1.Handler{
-									HTTPGet: &apiv1.HTTPGetAction{
-										Path: "/ping",
-										Port: intstr.FromString("http"),
-									},
-								},
-							},
-							ReadinessProbe: &apiv1.Probe{
-								InitialDelaySeconds: 0,
-								TimeoutSeconds:      1,
-								SuccessThreshold:    1,
-								PeriodSeconds:       10,
-								Handler: apiv1.Handler{
-									HTTPGet: &apiv1.HTTPGetAction{
-										Path: "/ping",
-										Port: intstr.FromString("http"),
-									},
-								},
-							},
-							VolumeMounts: []apiv1.VolumeMount{
-								apiv1.VolumeMount{
-									Name:      "configmain",
-									MountPath: "/etc/oauth2_proxy",
-								},
-							},
-						},
+						c.newProxyContainer(settings, spec),
 					},
 					Volumes: []apiv1.Volume{
-						apiv1.Volume{
-							Name: "configmain",
-							VolumeSource: apiv1.VolumeSource{
-								ConfigMap: &apiv1.ConfigMapVolumeSource{
-									DefaultMode: int32Ptr(420),
-									LocalObjectReference: apiv1.LocalObjectReference{
-										Name: fmt.Sprintf("oauth2-proxy-%s-%s-%s", c.Env.Provider, settings.GitHub.Organization, settings.AppName),
-									},
-								},
-							},
+						proxyConfigVolume("configmain", settings),
+					},
+				},
+			},
+		},
+	}
+	return deployment
+}
+
+// proxyConfigVolume - Volume of oauth2_proxy.cfg from ConfigMap of the app
+func proxyConfigVolume(name string, settings *models.ServiceSettings) apiv1.Volume {
+	return apiv1.Volume{
+		Name: name,
+		VolumeSource: apiv1.VolumeSource{
+			ConfigMap: &apiv1.ConfigMapVolumeSource{
+				DefaultMode: int32Ptr(420),
+				LocalObjectReference: apiv1.LocalObjectReference{
+					Name: proxyName(settings),
+				},
+			},
+		},
+	}
+}
+
+// newProxyContainer - oauth2_proxy container of the app
+func (c *Controller) newProxyContainer(settings *models.ServiceSettings, spec proxySpec) apiv1.Container {
+	container := apiv1.Container{
+		Name:  "oauth2-proxy",
+		Image: c.proxyImage(settings, spec.Release),
+		Args: []string{
+			"--http-address=0.0.0.0:4180",
+			fmt.Sprintf("--cookie-domain=%s", spec.CookieDomain),
+			fmt.Sprintf("--cookie-name=%s", cookieName(settings)),
+			"--email-domain=*",
+			fmt.Sprintf("--github-org=%s", settings.GitHub.Organization),
+			fmt.Sprintf("--github-team=%s", strings.Join(settings.GitHub.Teams, ",")),
+			fmt.Sprintf("--provider=github"),
+			fmt.Sprintf("--proxy-prefix=%s", proxyPath(settings)),
+			fmt.Sprintf("--redirect-url=https://%s%s/callback", spec.AuthHost, proxyPath(settings)),
+			fmt.Sprintf("--upstream=file:///dev/null"),
+			fmt.Sprintf("--whitelist-domain=%s", spec.WhitelistDomain),
+			fmt.Sprintf("--config=/etc/oauth2_proxy/oauth2_proxy.cfg"),
+		},
+		Env: []apiv1.EnvVar{
+			apiv1.EnvVar{
+				Name: "OAUTH2_PROXY_CLIENT_ID",
+				ValueFrom: &apiv1.EnvVarSource{
+					SecretKeyRef: &apiv1.SecretKeySelector{
+						LocalObjectReference: apiv1.LocalObjectReference{
+							Name: proxyName(settings),
+						},
+						Key: "client-id",
+					},
+				},
+			},
+			apiv1.EnvVar{
+				Name: "OAUTH2_PROXY_CLIENT_SECRET",
+				ValueFrom: &apiv1.EnvVarSource{
+					SecretKeyRef: &apiv1.SecretKeySelector{
+						LocalObjectReference: apiv1.LocalObjectReference{
+							Name: proxyName(settings),
 						},
+						Key: "client-secret",
 					},
 				},
 			},
+			apiv1.EnvVar{
+				Name: "OAUTH2_PROXY_COOKIE_SECRET",
+				ValueFrom: &apiv1.EnvVarSource{
+					SecretKeyRef: &apiv1.SecretKeySelector{
+						LocalObjectReference: apiv1.LocalObjectReference{
+							Name: proxyName(settings),
+						},
+						Key: c.cookieSecretKey(settings),
+					},
+				},
+			},
+			apiv1.EnvVar{
+				Name:  "OAUTH2_PROXY_SET_XAUTHREQUEST",
+				Value: settings.SetXAuthRequest,
+			},
+		},
+		Ports: []apiv1.ContainerPort{
+			{
+				Name:          "http",
+				Protocol:      apiv1.ProtocolTCP,
+				ContainerPort: 4180,
+			},
+		},
+		Resources:       spec.Deployment.Resources,
+		SecurityContext: hardenedSecurityContext(c.Proxy.RunAsUser),
+		LivenessProbe: &apiv1.Probe{
+			InitialDelaySeconds: 0,
+			TimeoutSeconds:      1,
+			Handler: apiv1.Handler{
+				HTTPGet: &apiv1.HTTPGetAction{
+					Path: "/ping",
+					Port: intstr.FromString("http"),
+				},
+			},
+		},
+		ReadinessProbe: &apiv1.Probe{
+			InitialDelaySeconds: 0,
+			TimeoutSeconds:      1,
+			SuccessThreshold:    1,
+			PeriodSeconds:       10,
+			Handler: apiv1.Handler{
+				HTTPGet: &apiv1.HTTPGetAction{
+					Path: "/ping",
+					Port: intstr.FromString("http"),
+				},
+			},
+		},
+		VolumeMounts: []apiv1.VolumeMount{
+			apiv1.VolumeMount{
+				Name:      "configmain",
+				MountPath: "/etc/oauth2_proxy",
+			},
 		},
 	}
 
+	// Session store
+	container.Args = append(container.Args, sessionStoreArgs(spec.SessionStore)...)
+	container.Env = append(container.Env, sessionStoreEnv(spec.SessionStore)...)
+	return container
+}
+
+func (c *Controller) applyDeployment(settings *models.ServiceSettings, spec proxySpec) {
+	deploymentsClient := c.Clientset.AppsV1beta2().Deployments("oauth2-proxy")
+	deployment := c.newDeployment(settings, spec)
+
 	// Create deployment...
 	logrus.Printf("[oauth2_proxy] Check Deployment...")
-	result, err := deploymentsClient.Get(fmt.Sprintf("oauth2-proxy-github-%s-%s", settings.GitHub.Organization, settings.AppName), metav1.GetOptions{})
-	if len(result.GetName()) == 0 {
-		// NotFound
+	result, err := deploymentsClient.Get(proxyName(settings), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		logrus.Panic(err)
+	}
+	if apierrors.IsNotFound(err) {
+		if c.dryRun("Deployment", nil, deployment) {
+			return
+		}
 		logrus.Printf("[oauth2_proxy] Creating Deployment...")
 		result, err = deploymentsClient.Create(deployment)
 		if err != nil {
@@ -419,6 +819,14 @@ func (c *Controller) applyDeployment(settings *models.ServiceSettings) {
 		}
 		logrus.Printf("[oauth2_proxy] Created Deployment! %q", result.GetObjectMeta().GetName())
 	} else {
+		// Replicas are owned by HorizontalPodAutoscaler
+		if autoscalingEnabled(spec.Deployment) && result.Spec.Replicas != nil {
+			deployment.Spec.Replicas = result.Spec.Replicas
+		}
+		if c.dryRun("Deployment", result, deployment) {
+			return
+		}
+
 		logrus.Printf("[oauth2_proxy] Update Deployment...")
 		result, err = deploymentsClient.Update(deployment)
 		if err != nil {
@@ -0,0 +1,742 @@
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/api/extensions/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/Laica-Lunasys/oauth2-proxy-manager/models"
+)
+
+func newTestConfig() *Config {
+	return &Config{
+		Domain:           "auth.example.com",
+		CookieDomain:     ".example.com",
+		CookieSalt:       "salt",
+		WhitelistDomain:  ".example.com",
+		Provider:         "github",
+		ClientID:         "client-id",
+		ClientSecret:     "client-secret",
+		Version:          DefaultProxyVersion,
+		IngressMode:      IngressModeShared,
+		AnnotationPrefix: DefaultAnnotationPrefix,
+		ResyncPeriod:     "0",
+		Proxy:            map[string]string{},
+	}
+}
+
+func newTestController(t *testing.T, cfg *Config) (*Controller, *fake.Clientset) {
+	clientset := fake.NewSimpleClientset()
+	controller, err := NewController(clientset, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return controller, clientset
+}
+
+func newTestSettings(app string) *models.ServiceSettings {
+	return &models.ServiceSettings{
+		AppName:    app,
+		AuthURL:    "https://auth.example.com/github/" + app + "/auth",
+		AuthSignIn: "https://auth.example.com/github/" + app + "/start",
+		GitHub: models.GitHubProvider{
+			Organization: "example-corp",
+			Teams:        []string{"admin", "dev"},
+		},
+	}
+}
+
+// ingressPaths - "host/path" => backend service of the Ingress
+func ingressPaths(t *testing.T, clientset *fake.Clientset, name string) map[string]string {
+	ingress, err := clientset.ExtensionsV1beta1().Ingresses("oauth2-proxy").Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	paths := map[string]string{}
+	for _, rule := range ingress.Spec.Rules {
+		for _, path := range rule.HTTP.Paths {
+			paths[rule.Host+path.Path] = path.Backend.ServiceName
+		}
+	}
+	return paths
+}
+
+func TestControllerApply(t *testing.T) {
+	controller, clientset := newTestController(t, newTestConfig())
+	controller.Apply(newTestSettings("supersecret"))
+
+	name := "oauth2-proxy-github-example-corp-supersecret"
+
+	service, err := clientset.CoreV1().Services("oauth2-proxy").Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.Spec.Type != "ClusterIP" || len(service.Spec.Ports) != 1 || service.Spec.Ports[0].Port != 80 {
+		t.Errorf("unexpected Service spec: %+v", service.Spec)
+	}
+	if service.Spec.Selector["app"] != name {
+		t.Errorf("Service selector = %v", service.Spec.Selector)
+	}
+
+	secret, err := clientset.CoreV1().Secrets("oauth2-proxy").Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.StringData["client-id"] != "client-id" || secret.StringData["client-secret"] != "client-secret" {
+		t.Errorf("unexpected Secret data: %v", secret.StringData)
+	}
+	if len(secret.StringData["github-example-corp-supersecret-cookie-secret"]) == 0 {
+		t.Errorf("cookie secret not found: %v", secret.StringData)
+	}
+
+	configMap, err := clientset.CoreV1().ConfigMaps("oauth2-proxy").Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := configMap.Data["oauth2_proxy.cfg"]; !ok {
+		t.Errorf("oauth2_proxy.cfg not found: %v", configMap.Data)
+	}
+
+	deployment, err := clientset.AppsV1beta2().Deployments("oauth2-proxy").Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *deployment.Spec.Replicas != 1 {
+		t.Errorf("replicas = %d, want 1", *deployment.Spec.Replicas)
+	}
+	container := deployment.Spec.Template.Spec.Containers[0]
+	if container.Image != "quay.io/pusher/oauth2_proxy:v3.2.0" {
+		t.Errorf("image = %q", container.Image)
+	}
+	for _, arg := range []string{
+		"--cookie-domain=.example.com",
+		"--github-org=example-corp",
+		"--github-team=admin,dev",
+		"--proxy-prefix=/github/supersecret",
+		"--redirect-url=https://auth.example.com/github/supersecret/callback",
+		"--whitelist-domain=.example.com",
+	} {
+		if !containsString(container.Args, arg) {
+			t.Errorf("arg %q not found in %v", arg, container.Args)
+		}
+	}
+
+	paths := ingressPaths(t, clientset, defaultSharedIngressName)
+	want := map[string]string{"auth.example.com/github/supersecret": name}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("Ingress paths = %v, want %v", paths, want)
+	}
+}
+
+func TestControllerApplyUpdate(t *testing.T) {
+	controller, clientset := newTestController(t, newTestConfig())
+	settings := newTestSettings("supersecret")
+	controller.Apply(settings)
+
+	settings.Deployment.Replicas = int32Ptr(3)
+	controller.Apply(settings)
+
+	deployment, err := clientset.AppsV1beta2().Deployments("oauth2-proxy").Get("oauth2-proxy-github-example-corp-supersecret", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *deployment.Spec.Replicas != 3 {
+		t.Errorf("replicas = %d, want 3", *deployment.Spec.Replicas)
+	}
+	if paths := ingressPaths(t, clientset, defaultSharedIngressName); len(paths) != 1 {
+		t.Errorf("Ingress paths = %v, want single path", paths)
+	}
+}
+
+func TestControllerAutoscalingMinReplicas(t *testing.T) {
+	controller, clientset := newTestController(t, newTestConfig())
+	settings := newTestSettings("supersecret")
+	// replicas: 0 with hpa-min-replicas
+	settings.Deployment.Replicas = int32Ptr(0)
+	settings.Deployment.Autoscaling.Enabled = boolPtr(true)
+	settings.Deployment.Autoscaling.MinReplicas = int32Ptr(2)
+	if err := controller.Apply(settings); err != nil {
+		t.Fatal(err)
+	}
+
+	hpa, err := clientset.AutoscalingV1().HorizontalPodAutoscalers("oauth2-proxy").Get("oauth2-proxy-github-example-corp-supersecret", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hpa.Spec.MinReplicas == nil || *hpa.Spec.MinReplicas != 2 {
+		t.Errorf("minReplicas = %v, want 2", hpa.Spec.MinReplicas)
+	}
+	deployment, err := clientset.AppsV1beta2().Deployments("oauth2-proxy").Get("oauth2-proxy-github-example-corp-supersecret", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *deployment.Spec.Replicas != 2 {
+		t.Errorf("replicas = %d, want 2", *deployment.Spec.Replicas)
+	}
+}
+
+func TestControllerAutoscalingGlobalZeroReplicas(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.Proxy = map[string]string{"replicas": "0"}
+	controller, clientset := newTestController(t, cfg)
+
+	// replicas: 0 from global defaults, hpa from annotation
+	settings := newTestSettings("supersecret")
+	settings.Deployment.Autoscaling.Enabled = boolPtr(true)
+	if err := controller.Apply(settings); err == nil || !strings.Contains(err.Error(), "replicas 0 can't be used with hpa") {
+		t.Fatalf("Apply() = %v, want replicas 0 error", err)
+	}
+	if _, err := clientset.AppsV1beta2().Deployments("oauth2-proxy").Get("oauth2-proxy-github-example-corp-supersecret", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Deployment should not be created, got %v", err)
+	}
+
+	settings.Deployment.Autoscaling.MinReplicas = int32Ptr(1)
+	if err := controller.Apply(settings); err != nil {
+		t.Fatal(err)
+	}
+	deployment, err := clientset.AppsV1beta2().Deployments("oauth2-proxy").Get("oauth2-proxy-github-example-corp-supersecret", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *deployment.Spec.Replicas != 1 {
+		t.Errorf("replicas = %d, want 1", *deployment.Spec.Replicas)
+	}
+}
+
+func TestControllerSharedIngress(t *testing.T) {
+	controller, clientset := newTestController(t, newTestConfig())
+	first := newTestSettings("first")
+	second := newTestSettings("second")
+	controller.Apply(first)
+	controller.Apply(second)
+
+	want := map[string]string{
+		"auth.example.com/github/first":  "oauth2-proxy-github-example-corp-first",
+		"auth.example.com/github/second": "oauth2-proxy-github-example-corp-second",
+	}
+	if paths := ingressPaths(t, clientset, defaultSharedIngressName); !reflect.DeepEqual(paths, want) {
+		t.Errorf("Ingress paths = %v, want %v", paths, want)
+	}
+
+	controller.Delete(first)
+	delete(want, "auth.example.com/github/first")
+	if paths := ingressPaths(t, clientset, defaultSharedIngressName); !reflect.DeepEqual(paths, want) {
+		t.Errorf("Ingress paths = %v, want %v", paths, want)
+	}
+
+	controller.Delete(second)
+	if paths := ingressPaths(t, clientset, defaultSharedIngressName); paths != nil {
+		t.Errorf("Ingress without paths should be deleted, got %v", paths)
+	}
+}
+
+func TestControllerSharedIngressDeleteConflict(t *testing.T) {
+	controller, clientset := newTestController(t, newTestConfig())
+	first := newTestSettings("first")
+	controller.Apply(first)
+
+	// Another writer adds a path between Get and Delete of the last path
+	ingresses := v1beta1.SchemeGroupVersion.WithResource("ingresses")
+	conflicted := false
+	clientset.PrependReactor("delete", "ingresses", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicted {
+			return false, nil, nil
+		}
+		conflicted = true
+		obj, err := clientset.Tracker().Get(ingresses, "oauth2-proxy", defaultSharedIngressName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ingress := obj.(*v1beta1.Ingress).DeepCopy()
+		ingress.Spec.Rules[0].HTTP.Paths = append(ingress.Spec.Rules[0].HTTP.Paths, v1beta1.HTTPIngressPath{
+			Path:    "/github/second",
+			Backend: v1beta1.IngressBackend{ServiceName: "oauth2-proxy-github-example-corp-second", ServicePort: intstr.FromInt(80)},
+		})
+		if err := clientset.Tracker().Update(ingresses, ingress, "oauth2-proxy"); err != nil {
+			t.Fatal(err)
+		}
+		return true, nil, apierrors.NewConflict(ingresses.GroupResource(), defaultSharedIngressName, nil)
+	})
+
+	controller.Delete(first)
+	want := map[string]string{"auth.example.com/github/second": "oauth2-proxy-github-example-corp-second"}
+	if paths := ingressPaths(t, clientset, defaultSharedIngressName); !reflect.DeepEqual(paths, want) {
+		t.Errorf("Ingress paths = %v, want %v", paths, want)
+	}
+}
+
+func TestControllerPerAppIngress(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.IngressMode = IngressModePerApp
+	controller, clientset := newTestController(t, cfg)
+	settings := newTestSettings("supersecret")
+	settings.AuthHost = "auth.example.net"
+	controller.Apply(settings)
+
+	name := "oauth2-proxy-github-example-corp-supersecret"
+	want := map[string]string{"auth.example.net/github/supersecret": name}
+	if paths := ingressPaths(t, clientset, name); !reflect.DeepEqual(paths, want) {
+		t.Errorf("Ingress paths = %v, want %v", paths, want)
+	}
+	if paths := ingressPaths(t, clientset, defaultSharedIngressName); paths != nil {
+		t.Errorf("shared Ingress should not exist, got %v", paths)
+	}
+}
+
+func TestControllerPerAppIngressCertificates(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.IngressMode = IngressModePerApp
+	cfg.ClusterIssuer = "letsencrypt"
+	controller, clientset := newTestController(t, cfg)
+
+	// Apps on the same auth host don't claim one Certificate
+	secrets := map[string]bool{}
+	for _, app := range []string{"first", "second"} {
+		controller.Apply(newTestSettings(app))
+		ingress, err := clientset.ExtensionsV1beta1().Ingresses("oauth2-proxy").Get("oauth2-proxy-github-example-corp-"+app, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ingress.Spec.TLS) != 1 {
+			t.Fatalf("TLS = %+v, want single entry", ingress.Spec.TLS)
+		}
+		secrets[ingress.Spec.TLS[0].SecretName] = true
+	}
+	want := map[string]bool{"oauth2-proxy-github-example-corp-first-tls": true, "oauth2-proxy-github-example-corp-second-tls": true}
+	if !reflect.DeepEqual(secrets, want) {
+		t.Errorf("TLS secrets = %v, want %v", secrets, want)
+	}
+}
+
+func TestControllerIngressControllers(t *testing.T) {
+	controller, clientset := newTestController(t, newTestConfig())
+	nginx := newTestSettings("first")
+	traefik := newTestSettings("second")
+	traefik.IngressController = IngressControllerTraefik
+	controller.Apply(nginx)
+	controller.Apply(traefik)
+
+	// Each controller serves its own shared Ingress
+	if paths := ingressPaths(t, clientset, "oauth2-proxy-traefik"); !reflect.DeepEqual(paths, map[string]string{
+		"auth.example.com/github/second": "oauth2-proxy-github-example-corp-second",
+	}) {
+		t.Errorf("Traefik Ingress paths = %v", paths)
+	}
+	ingress, err := clientset.ExtensionsV1beta1().Ingresses("oauth2-proxy").Get("oauth2-proxy-traefik", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if class := ingress.Annotations["kubernetes.io/ingress.class"]; class != IngressControllerTraefik {
+		t.Errorf("ingress.class = %q, want traefik", class)
+	}
+
+	// Moved to shared Ingress of the new controller
+	traefik.IngressController = IngressControllerNginx
+	controller.Apply(traefik)
+	want := map[string]string{
+		"auth.example.com/github/first":  "oauth2-proxy-github-example-corp-first",
+		"auth.example.com/github/second": "oauth2-proxy-github-example-corp-second",
+	}
+	if paths := ingressPaths(t, clientset, defaultSharedIngressName); !reflect.DeepEqual(paths, want) {
+		t.Errorf("Ingress paths = %v, want %v", paths, want)
+	}
+	if paths := ingressPaths(t, clientset, "oauth2-proxy-traefik"); paths != nil {
+		t.Errorf("Traefik Ingress without paths should be deleted, got %v", paths)
+	}
+}
+
+func TestControllerGateway(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.Gateway = "gateway-system/public"
+	controller, clientset := newTestController(t, cfg)
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	controller.Dynamic = dynamicClient
+	settings := newTestSettings("supersecret")
+	controller.Apply(settings)
+
+	name := "oauth2-proxy-github-example-corp-supersecret"
+	routeClient := dynamicClient.Resource(httpRouteResource).Namespace("oauth2-proxy")
+	route, err := routeClient.Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parentRefs, _, _ := unstructured.NestedSlice(route.Object, "spec", "parentRefs")
+	if want := []interface{}{map[string]interface{}{"namespace": "gateway-system", "name": "public"}}; !reflect.DeepEqual(parentRefs, want) {
+		t.Errorf("parentRefs = %v, want %v", parentRefs, want)
+	}
+	rules, _, _ := unstructured.NestedSlice(route.Object, "spec", "rules")
+	if len(rules) != 1 {
+		t.Fatalf("rules = %v", rules)
+	}
+	matches := rules[0].(map[string]interface{})["matches"].([]interface{})
+	if value, _, _ := unstructured.NestedString(matches[0].(map[string]interface{}), "path", "value"); value != "/github/supersecret" {
+		t.Errorf("path = %q, want /github/supersecret", value)
+	}
+	if paths := ingressPaths(t, clientset, defaultSharedIngressName); paths != nil {
+		t.Errorf("Ingress should not exist with Gateway, got %v", paths)
+	}
+
+	// Migrated back to Ingress
+	cfg.Gateway = ""
+	if _, err := controller.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	controller.Apply(settings)
+	if _, err := routeClient.Get(name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("HTTPRoute should be deleted, got err=%v", err)
+	}
+	if paths := ingressPaths(t, clientset, defaultSharedIngressName); paths["auth.example.com/github/supersecret"] != name {
+		t.Errorf("Ingress paths = %v", paths)
+	}
+}
+
+func TestControllerDelete(t *testing.T) {
+	controller, clientset := newTestController(t, newTestConfig())
+	settings := newTestSettings("supersecret")
+	controller.Apply(settings)
+	controller.Delete(settings)
+
+	name := "oauth2-proxy-github-example-corp-supersecret"
+	gets := map[string]func() error{
+		"Service": func() error {
+			_, err := clientset.CoreV1().Services("oauth2-proxy").Get(name, metav1.GetOptions{})
+			return err
+		},
+		"Secret": func() error {
+			_, err := clientset.CoreV1().Secrets("oauth2-proxy").Get(name, metav1.GetOptions{})
+			return err
+		},
+		"ConfigMap": func() error {
+			_, err := clientset.CoreV1().ConfigMaps("oauth2-proxy").Get(name, metav1.GetOptions{})
+			return err
+		},
+		"Deployment": func() error {
+			_, err := clientset.AppsV1beta2().Deployments("oauth2-proxy").Get(name, metav1.GetOptions{})
+			return err
+		},
+		"Ingress": func() error {
+			_, err := clientset.ExtensionsV1beta1().Ingresses("oauth2-proxy").Get(defaultSharedIngressName, metav1.GetOptions{})
+			return err
+		},
+	}
+	for kind, get := range gets {
+		if err := get(); !apierrors.IsNotFound(err) {
+			t.Errorf("%s should be deleted, got err=%v", kind, err)
+		}
+	}
+}
+
+func TestControllerInstances(t *testing.T) {
+	controller, clientset := newTestController(t, newTestConfig())
+	cfg := newTestConfig()
+	cfg.AnnotationPrefix = "team-a.example.com"
+	cfg.Instance = "team-a"
+	teamA, err := NewController(clientset, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each instance claims only Ingresses of its prefix
+	ingress := newTestIngress("supersecret", nil)
+	if _, err := parseAnnotations(ingress.ObjectMeta, teamA.Instance); err == nil {
+		t.Error("team-a should not claim Ingress annotated for default instance")
+	}
+	settings, err := parseAnnotations(ingress.ObjectMeta, controller.Instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller.Apply(settings)
+
+	ingress = newTestIngress("supersecret", nil)
+	for key, value := range ingress.Annotations {
+		if strings.HasPrefix(key, DefaultAnnotationPrefix+"/") {
+			delete(ingress.Annotations, key)
+			ingress.Annotations["team-a.example.com/"+strings.TrimPrefix(key, DefaultAnnotationPrefix+"/")] = value
+		}
+	}
+	if _, err := parseAnnotations(ingress.ObjectMeta, controller.Instance); err == nil {
+		t.Error("default instance should not claim Ingress annotated for team-a")
+	}
+	settings, err = parseAnnotations(ingress.ObjectMeta, teamA.Instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	teamA.Apply(settings)
+
+	// Same app in both instances doesn't conflict: objects and paths on the same host differ
+	for ingressName, want := range map[string]map[string]string{
+		"oauth2-proxy":        {"auth.example.com/github/supersecret": "oauth2-proxy-github-example-corp-supersecret"},
+		"oauth2-proxy-team-a": {"auth.example.com/github-team-a/supersecret": "oauth2-proxy-team-a-github-example-corp-supersecret"},
+	} {
+		if paths := ingressPaths(t, clientset, ingressName); !reflect.DeepEqual(paths, want) {
+			t.Errorf("Ingress %s paths = %v, want %v", ingressName, paths, want)
+		}
+	}
+	deployment, err := clientset.AppsV1beta2().Deployments("oauth2-proxy").Get("oauth2-proxy-team-a-github-example-corp-supersecret", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance := deployment.Labels[instanceLabel]; instance != "team-a" {
+		t.Errorf("instance label = %q, want team-a", instance)
+	}
+	if !containsString(deployment.Spec.Template.Spec.Containers[0].Args, "--cookie-name=_github_team-a_example-corp_supersecret_oauth2_proxy") {
+		t.Errorf("cookie name should contain instance, got %v", deployment.Spec.Template.Spec.Containers[0].Args)
+	}
+	authURL, _ := teamA.authURLs(settings)
+	if authURL != "https://auth.example.com/github-team-a/supersecret/auth" {
+		t.Errorf("auth-url = %q, want path of team-a", authURL)
+	}
+}
+
+func TestControllerPublicIngress(t *testing.T) {
+	controller, clientset := newTestController(t, newTestConfig())
+	source := newTestIngress("supersecret", nil)
+	source.Spec.Rules = []v1beta1.IngressRule{{
+		Host: "supersecret.example.com",
+		IngressRuleValue: v1beta1.IngressRuleValue{HTTP: &v1beta1.HTTPIngressRuleValue{
+			Paths: []v1beta1.HTTPIngressPath{{Path: "/", Backend: v1beta1.IngressBackend{ServiceName: "supersecret", ServicePort: intstr.FromInt(80)}}},
+		}},
+	}}
+	settings := newTestSettings("supersecret")
+	settings.PublicPaths = []string{"/healthz"}
+	controller.ApplyPublicIngress(source, settings)
+
+	public, err := clientset.ExtensionsV1beta1().Ingresses("supersecret").Get("supersecret-public", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := public.Annotations["nginx.ingress.kubernetes.io/auth-url"]; ok {
+		t.Error("public Ingress should not have auth-url")
+	}
+	if paths := public.Spec.Rules[0].HTTP.Paths; len(paths) != 1 || paths[0].Path != "^/healthz$" || paths[0].Backend.ServiceName != "supersecret" {
+		t.Errorf("public paths = %+v", paths)
+	}
+	// "/healthz-admin" is not public
+	if public.Annotations["nginx.ingress.kubernetes.io/use-regex"] != "true" {
+		t.Errorf("public paths should match exactly with use-regex, got %v", public.Annotations)
+	}
+
+	// Removed without public paths
+	settings.PublicPaths = nil
+	controller.ApplyPublicIngress(source, settings)
+	if _, err := clientset.ExtensionsV1beta1().Ingresses("supersecret").Get("supersecret-public", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("public Ingress should be deleted, got err=%v", err)
+	}
+
+	// Ingress of the same name made by user is kept
+	own := &v1beta1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "supersecret-public", Namespace: "supersecret"}}
+	if _, err := clientset.ExtensionsV1beta1().Ingresses("supersecret").Create(own); err != nil {
+		t.Fatal(err)
+	}
+	controller.DeletePublicIngress(source)
+	settings.PublicPaths = []string{"/healthz"}
+	controller.ApplyPublicIngress(source, settings)
+	public, err = clientset.ExtensionsV1beta1().Ingresses("supersecret").Get("supersecret-public", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Ingress made by user should be kept, got err=%v", err)
+	}
+	if len(public.Spec.Rules) != 0 {
+		t.Errorf("Ingress made by user should not be overwritten, got %+v", public.Spec.Rules)
+	}
+}
+
+func TestControllerSharedProxy(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.Version = "v7.1.3"
+	cfg.Proxy["sharing"] = ProxySharingPerOrg
+	controller, clientset := newTestController(t, cfg)
+	exists := func(name string) bool {
+		_, err := clientset.AppsV1beta2().Deployments("oauth2-proxy").Get(name, metav1.GetOptions{})
+		return err == nil
+	}
+	shared := "oauth2-proxy-github-example-corp"
+
+	// Apps of the org share one oauth2_proxy, served on its own path
+	for _, app := range []string{"supersecret", "topsecret"} {
+		if err := controller.Apply(newTestSettings(app)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deployment, err := clientset.AppsV1beta2().Deployments("oauth2-proxy").Get(shared, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := deployment.Spec.Template.Spec.Containers[0].Args
+	for _, arg := range []string{"--proxy-prefix=/github-org/example-corp", "--github-team=", "--cookie-name=_github_example-corp_oauth2_proxy"} {
+		if !containsString(args, arg) {
+			t.Errorf("args should contain %s, got %v", arg, args)
+		}
+	}
+	if exists("oauth2-proxy-github-example-corp-supersecret") {
+		t.Error("app should not have its own oauth2_proxy")
+	}
+	want := map[string]string{"auth.example.com/github-org/example-corp": shared}
+	if paths := ingressPaths(t, clientset, defaultSharedIngressName); !reflect.DeepEqual(paths, want) {
+		t.Errorf("paths = %v, want %v", paths, want)
+	}
+	configMap, err := clientset.CoreV1().ConfigMaps("oauth2-proxy").Get(shared, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apps := configMap.Annotations[DefaultAnnotationPrefix+"/"+sharedProxyAppsKey]; apps != "supersecret,topsecret" {
+		t.Errorf("apps = %q, want supersecret,topsecret", apps)
+	}
+
+	// Teams are checked per app by allowed_groups
+	authURL, authSignIn := controller.authURLs(newTestSettings("supersecret"))
+	if authURL != "https://auth.example.com/github-org/example-corp/auth?allowed_groups=example-corp:admin,example-corp:dev" {
+		t.Errorf("auth-url = %s", authURL)
+	}
+	if !strings.HasPrefix(authSignIn, "https://auth.example.com/github-org/example-corp/start?rd=") {
+		t.Errorf("auth-signin = %s", authSignIn)
+	}
+
+	// Settings of oauth2_proxy itself can't be set per app
+	settings := newTestSettings("custom")
+	settings.Image = "example.com/oauth2-proxy"
+	if err := controller.Apply(settings); err == nil || !strings.Contains(err.Error(), "image") {
+		t.Errorf("Apply should fail with image, got %v", err)
+	}
+
+	// The app may have its own oauth2_proxy
+	settings = newTestSettings("topsecret")
+	settings.Sharing = ProxySharingPerApp
+	controller.Apply(settings)
+	if !exists("oauth2-proxy-github-example-corp-topsecret") || !exists(shared) {
+		t.Error("topsecret should have its own oauth2_proxy, and supersecret keeps shared one")
+	}
+
+	// Shared oauth2_proxy is removed with its last app
+	controller.Delete(newTestSettings("supersecret"))
+	if exists(shared) {
+		t.Error("shared oauth2_proxy should be deleted")
+	}
+	want = map[string]string{"auth.example.com/github/topsecret": "oauth2-proxy-github-example-corp-topsecret"}
+	if paths := ingressPaths(t, clientset, defaultSharedIngressName); !reflect.DeepEqual(paths, want) {
+		t.Errorf("paths = %v, want %v", paths, want)
+	}
+
+	// oauth2_proxy older than v7 has no allowed_groups
+	cfg.Version = DefaultProxyVersion
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "allowed_groups") {
+		t.Errorf("Validate should fail with %s, got %v", cfg.Version, err)
+	}
+}
+
+func TestControllerSharedProxyConfigMapRecreated(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.Version = "v7.1.3"
+	cfg.Proxy["sharing"] = ProxySharingPerOrg
+	controller, clientset := newTestController(t, cfg)
+	shared := "oauth2-proxy-github-example-corp"
+	for _, app := range []string{"supersecret", "topsecret"} {
+		if err := controller.Apply(newTestSettings(app)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// ConfigMap deleted by someone, recreated by drift correction of one app
+	if err := clientset.CoreV1().ConfigMaps("oauth2-proxy").Delete(shared, nil); err != nil {
+		t.Fatal(err)
+	}
+	controller.Apply(newTestSettings("supersecret"))
+	configMap, err := clientset.CoreV1().ConfigMaps("oauth2-proxy").Get(shared, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apps := configMap.Annotations[DefaultAnnotationPrefix+"/"+sharedProxyAppsKey]; apps != "supersecret,topsecret" {
+		t.Errorf("apps = %q, want supersecret,topsecret", apps)
+	}
+
+	// Still used by topsecret
+	controller.Delete(newTestSettings("supersecret"))
+	if _, err := clientset.AppsV1beta2().Deployments("oauth2-proxy").Get(shared, metav1.GetOptions{}); err != nil {
+		t.Errorf("shared oauth2_proxy should be kept for topsecret, got %v", err)
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestControllerManagedRedis(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.Version = "v7.1.3"
+	cfg.Proxy["session-store"] = SessionStoreRedis
+	cfg.Proxy["managed-redis"] = "true"
+	controller, clientset := newTestController(t, cfg)
+	deployments := clientset.AppsV1beta2().Deployments("oauth2-proxy")
+	exists := func() bool {
+		_, err := deployments.Get(defaultManagedRedisName, metav1.GetOptions{})
+		return err == nil
+	}
+
+	for _, app := range []string{"supersecret", "topsecret"} {
+		if err := controller.Apply(newTestSettings(app)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deployment, err := deployments.Get(defaultManagedRedisName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	container := deployment.Spec.Template.Spec.Containers[0]
+	if !containsString(container.Args, "--requirepass") {
+		t.Errorf("args should contain --requirepass, got %v", container.Args)
+	}
+	if context := container.SecurityContext; context == nil || context.ReadOnlyRootFilesystem == nil || !*context.ReadOnlyRootFilesystem {
+		t.Errorf("securityContext should be hardened, got %v", context)
+	}
+	secret, err := clientset.CoreV1().Secrets("oauth2-proxy").Get(defaultManagedRedisName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	password := secret.StringData[managedRedisPasswordKey]
+	if len(password) == 0 || !strings.Contains(secret.StringData[DefaultRedisSecretKey], ":"+password+"@") {
+		t.Errorf("connection URL should have requirepass, got %q", secret.StringData[DefaultRedisSecretKey])
+	}
+
+	// Whole spec is reconciled, not only the image
+	deployment.Spec.Template.Spec.Containers[0].Args = nil
+	if _, err := deployments.Update(deployment); err != nil {
+		t.Fatal(err)
+	}
+	controller.Apply(newTestSettings("supersecret"))
+	if deployment, _ = deployments.Get(defaultManagedRedisName, metav1.GetOptions{}); !containsString(deployment.Spec.Template.Spec.Containers[0].Args, "--requirepass") {
+		t.Errorf("args should be reconciled, got %v", deployment.Spec.Template.Spec.Containers[0].Args)
+	}
+
+	// Kept while an app uses it
+	controller.Delete(newTestSettings("supersecret"))
+	if !exists() {
+		t.Error("managed Redis should be kept for topsecret")
+	}
+
+	// Removed when the last app moves to cookie
+	settings := newTestSettings("topsecret")
+	settings.SessionStore.Type = SessionStoreCookie
+	controller.Apply(settings)
+	if exists() {
+		t.Error("managed Redis should be deleted without apps")
+	}
+	if _, err := clientset.CoreV1().Secrets("oauth2-proxy").Get(defaultManagedRedisName, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Secret of managed Redis should be deleted, got %v", err)
+	}
+}
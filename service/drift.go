@@ -0,0 +1,232 @@
+package service
+
+import (
+	"reflect"
+	"sort"
+
+	appsv1beta2 "k8s.io/api/apps/v1beta2"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/Laica-Lunasys/oauth2-proxy-manager/models"
+	"github.com/sirupsen/logrus"
+)
+
+// childWatchers - Informers of objects generated by this instance, to correct drift / deletion by others.
+// Objects are found by labels of the instance, so objects created before they were labeled are not watched until next apply.
+func (ob *Observer) childWatchers() {
+	selector := labels.SelectorFromSet(ob.Controller.Instance.labels()).String()
+	children := []struct {
+		kind   string
+		object runtime.Object
+		list   func(options metav1.ListOptions) (runtime.Object, error)
+		watch  func(options metav1.ListOptions) (watch.Interface, error)
+	}{
+		{"Deployment", &appsv1beta2.Deployment{},
+			func(options metav1.ListOptions) (runtime.Object, error) {
+				return ob.Clientset.AppsV1beta2().Deployments("oauth2-proxy").List(options)
+			},
+			func(options metav1.ListOptions) (watch.Interface, error) {
+				return ob.Clientset.AppsV1beta2().Deployments("oauth2-proxy").Watch(options)
+			},
+		},
+		{"Service", &v1.Service{},
+			func(options metav1.ListOptions) (runtime.Object, error) {
+				return ob.Clientset.CoreV1().Services("oauth2-proxy").List(options)
+			},
+			func(options metav1.ListOptions) (watch.Interface, error) {
+				return ob.Clientset.CoreV1().Services("oauth2-proxy").Watch(options)
+			},
+		},
+		{"Secret", &v1.Secret{},
+			func(options metav1.ListOptions) (runtime.Object, error) {
+				return ob.Clientset.CoreV1().Secrets("oauth2-proxy").List(options)
+			},
+			func(options metav1.ListOptions) (watch.Interface, error) {
+				return ob.Clientset.CoreV1().Secrets("oauth2-proxy").Watch(options)
+			},
+		},
+		{"ConfigMap", &v1.ConfigMap{},
+			func(options metav1.ListOptions) (runtime.Object, error) {
+				return ob.Clientset.CoreV1().ConfigMaps("oauth2-proxy").List(options)
+			},
+			func(options metav1.ListOptions) (watch.Interface, error) {
+				return ob.Clientset.CoreV1().ConfigMaps("oauth2-proxy").Watch(options)
+			},
+		},
+	}
+
+	for _, child := range children {
+		child := child
+		_, informer := cache.NewInformer(&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.LabelSelector = selector
+				return child.list(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.LabelSelector = selector
+				return child.watch(options)
+			},
+		}, child.object, 0, ob.childHandler(child.kind))
+		ob.informers = append(ob.informers, informer)
+	}
+}
+
+// childHandler - Reconcile the owning app when generated object is changed or deleted.
+// Objects written by the manager itself don't differ from generated ones, so they're left as is.
+func (ob *Observer) childHandler(kind string) cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			ob.reconcileChild(kind, obj.(runtime.Object), false)
+		},
+		UpdateFunc: func(old interface{}, new interface{}) {
+			ob.reconcileChild(kind, new.(runtime.Object), false)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if child, ok := obj.(runtime.Object); ok {
+				ob.reconcileChild(kind, child, true)
+			}
+		},
+	}
+}
+
+// reconcileChild - Apply the app owning child again, if child was deleted or differs from what the manager generates
+// Owner is looked up under lock: app removed meanwhile is not in the index anymore.
+func (ob *Observer) reconcileChild(kind string, child runtime.Object, deleted bool) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	name := objectKey(child)
+	key, settings := ob.owner(child)
+	if settings == nil {
+		// Removed together with its Ingress
+		return
+	}
+
+	if deleted {
+		logrus.Warnf("[Drift] %s %s was deleted, reconciling %s", kind, name, key)
+	} else {
+		diff, err := ob.Controller.drift(settings, child)
+		if err != nil {
+			logrus.Errorf("[Drift] %s %s: %s", kind, name, err)
+			return
+		}
+		if len(diff) == 0 {
+			return
+		}
+		logrus.Warnf("[Drift] %s %s was changed, reconciling %s:\n%s", kind, name, key, diff)
+	}
+	ob.Controller.Apply(settings)
+}
+
+// owner - Kind / key and settings of observed Ingress / HTTPRoute which generates child, looked up in the index of applied apps.
+// Managed Redis and oauth2_proxy shared by an org are owned by the first app using them.
+func (ob *Observer) owner(child runtime.Object) (string, *models.ServiceSettings) {
+	accessor, err := meta.Accessor(child)
+	if err != nil {
+		return "", nil
+	}
+	name := accessor.GetName()
+
+	if source := firstSource(ob.sources[name]); len(source) != 0 {
+		return source, ob.sources[name][source]
+	}
+	// Shared oauth2_proxy / managed Redis: not named after the apps using them
+	proxies := make([]string, 0, len(ob.sources))
+	for proxy := range ob.sources {
+		proxies = append(proxies, proxy)
+	}
+	sort.Strings(proxies)
+	for _, proxy := range proxies {
+		source := firstSource(ob.sources[proxy])
+		settings := ob.sources[proxy][source]
+		if ob.Controller.servingProxyName(settings) == name || (name == ob.Controller.managedRedisName() && ob.Controller.usesManagedRedis(settings)) {
+			return source, settings
+		}
+	}
+	return "", nil
+}
+
+// index - Record the app applied for source (e.g. "Ingress default/example"), replacing previous one
+func (ob *Observer) index(source string, settings *models.ServiceSettings) {
+	ob.unindex(source)
+	if ob.sources == nil {
+		ob.sources = map[string]map[string]*models.ServiceSettings{}
+		ob.sourceProxies = map[string]string{}
+	}
+	name := proxyName(settings)
+	if ob.sources[name] == nil {
+		ob.sources[name] = map[string]*models.ServiceSettings{}
+	}
+	ob.sources[name][source] = settings
+	ob.sourceProxies[source] = name
+}
+
+// unindex - Forget the app applied for source
+func (ob *Observer) unindex(source string) {
+	name, ok := ob.sourceProxies[source]
+	if !ok {
+		return
+	}
+	delete(ob.sources[name], source)
+	if len(ob.sources[name]) == 0 {
+		delete(ob.sources, name)
+	}
+	delete(ob.sourceProxies, source)
+}
+
+// firstSource - Source owning the oauth2_proxy when several Ingresses / HTTPRoutes use it, stable across lookups
+func firstSource(sources map[string]*models.ServiceSettings) string {
+	first := ""
+	for source := range sources {
+		if len(first) == 0 || source < first {
+			first = source
+		}
+	}
+	return first
+}
+
+// usesManagedRedis - Whether sessions of the app are stored in managed Redis
+func (c *Controller) usesManagedRedis(settings *models.ServiceSettings) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	spec, err := c.resolve(settings)
+	return err == nil && spec.SessionStore.RedisSecretName == c.managedRedisName()
+}
+
+// drift - Diff of live object from the object generated for the app. Empty if not drifted.
+func (c *Controller) drift(settings *models.ServiceSettings, live runtime.Object) (string, error) {
+	c.mu.Lock()
+	objects, err := c.Render(settings)
+	c.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	autoscaled := false
+	for _, obj := range objects {
+		if _, ok := obj.(*autoscalingv1.HorizontalPodAutoscaler); ok {
+			autoscaled = true
+		}
+	}
+	for _, desired := range objects {
+		if reflect.TypeOf(desired) != reflect.TypeOf(live) || objectKey(desired) != objectKey(live) {
+			continue
+		}
+		// Replicas are owned by HorizontalPodAutoscaler
+		if deployment, ok := desired.(*appsv1beta2.Deployment); ok && autoscaled {
+			deployment.Spec.Replicas = live.(*appsv1beta2.Deployment).Spec.Replicas
+		}
+		return objectDiff(live, desired)
+	}
+	return "", nil
+}
@@ -0,0 +1,255 @@
+package service
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dryRunReport - Changes Apply / Delete would make, in dry-run mode
+type dryRunReport struct {
+	Create    int
+	Update    int
+	Delete    int
+	Unchanged int
+}
+
+func (r dryRunReport) String() string {
+	return fmt.Sprintf("%d to create, %d to update, %d to delete, %d unchanged", r.Create, r.Update, r.Delete, r.Unchanged)
+}
+
+// dryRun - In dry-run mode, log what would be written instead of writing, and return true.
+// live is nil when the object would be created.
+func (c *Controller) dryRun(kind string, live, desired runtime.Object) bool {
+	if !c.DryRun {
+		return false
+	}
+	name := objectKey(desired)
+
+	if live == nil {
+		c.report.Create++
+		manifest, err := renderObject(desired)
+		if err != nil {
+			logrus.Panic(err)
+		}
+		logrus.Infof("[dry-run] Would create %s %s:\n%s", kind, name, manifest)
+		return true
+	}
+
+	diff, err := objectDiff(live, desired)
+	if err != nil {
+		logrus.Panic(err)
+	}
+	if len(diff) == 0 {
+		c.report.Unchanged++
+		logrus.Debugf("[dry-run] %s %s is up to date", kind, name)
+		return true
+	}
+	c.report.Update++
+	logrus.Infof("[dry-run] Would update %s %s:\n%s", kind, name, diff)
+	return true
+}
+
+// objectExists - Whether the object exists. In dry-run mode, read instead of deleting it.
+func (c *Controller) objectExists(kind string, namespace string, name string) (bool, error) {
+	options := metav1.GetOptions{}
+	var err error
+	switch kind {
+	case "Service":
+		_, err = c.Clientset.CoreV1().Services(namespace).Get(name, options)
+	case "Secret":
+		_, err = c.Clientset.CoreV1().Secrets(namespace).Get(name, options)
+	case "ConfigMap":
+		_, err = c.Clientset.CoreV1().ConfigMaps(namespace).Get(name, options)
+	case "Deployment":
+		_, err = c.Clientset.AppsV1beta2().Deployments(namespace).Get(name, options)
+	case "PodDisruptionBudget":
+		_, err = c.Clientset.PolicyV1beta1().PodDisruptionBudgets(namespace).Get(name, options)
+	case "HorizontalPodAutoscaler":
+		_, err = c.Clientset.AutoscalingV1().HorizontalPodAutoscalers(namespace).Get(name, options)
+	case "Ingress":
+		_, err = c.Clientset.ExtensionsV1beta1().Ingresses(namespace).Get(name, options)
+	case "HTTPRoute":
+		if c.Dynamic == nil {
+			return false, nil
+		}
+		_, err = c.Dynamic.Resource(httpRouteResource).Namespace(namespace).Get(name, options)
+		if apierrors.IsForbidden(err) && !c.gatewayEnabled() {
+			return false, nil
+		}
+	default:
+		return false, fmt.Errorf("unknown kind %q", kind)
+	}
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func objectKey(obj runtime.Object) string {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return "<unknown>"
+	}
+	return accessor.GetNamespace() + "/" + accessor.GetName()
+}
+
+// objectDiff - Line diff of fields set by the manager. Fields defaulted or added by others are ignored.
+func objectDiff(live, desired runtime.Object) (string, error) {
+	liveMap, err := diffableObject(live)
+	if err != nil {
+		return "", err
+	}
+	desiredMap, err := diffableObject(desired)
+	if err != nil {
+		return "", err
+	}
+
+	liveYAML, err := yaml.Marshal(projectFields(liveMap, desiredMap))
+	if err != nil {
+		return "", err
+	}
+	desiredYAML, err := yaml.Marshal(desiredMap)
+	if err != nil {
+		return "", err
+	}
+	return lineDiff(string(liveYAML), string(desiredYAML)), nil
+}
+
+// diffableObject - Object as map, without status / server fields, and with values of Secret hashed
+func diffableObject(obj runtime.Object) (map[string]interface{}, error) {
+	if secret, ok := obj.(*apiv1.Secret); ok {
+		secret = secret.DeepCopy()
+		if secret.Data == nil && len(secret.StringData) != 0 {
+			secret.Data = map[string][]byte{}
+		}
+		for key, value := range secret.StringData {
+			secret.Data[key] = []byte(value)
+		}
+		secret.StringData = nil
+		for key, value := range secret.Data {
+			sum := sha256.Sum256(value)
+			secret.Data[key] = []byte(fmt.Sprintf("<redacted %x>", sum[:4]))
+		}
+		obj = secret
+	}
+
+	m, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	delete(m, "status")
+	if metadata, ok := m["metadata"].(map[string]interface{}); ok {
+		delete(metadata, "creationTimestamp")
+	}
+	return m, nil
+}
+
+// projectFields - Fields of live which exist in desired
+func projectFields(live, desired interface{}) interface{} {
+	switch d := desired.(type) {
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			return live
+		}
+		projected := map[string]interface{}{}
+		for key, value := range d {
+			if liveValue, ok := l[key]; ok {
+				projected[key] = projectFields(liveValue, value)
+			}
+		}
+		return projected
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok || len(l) != len(d) {
+			return live
+		}
+		projected := make([]interface{}, len(l))
+		for i := range l {
+			projected[i] = projectFields(l[i], d[i])
+		}
+		return projected
+	}
+	return live
+}
+
+// lineDiff - "- " for lines only in a, "+ " for lines only in b. Empty if equal.
+func lineDiff(a, b string) string {
+	if a == b {
+		return ""
+	}
+	x := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	y := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+
+	// Longest common subsequence
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	// Edit script: ' ' common, '-' only in a, '+' only in b
+	type line struct {
+		op   byte
+		text string
+	}
+	lines := []line{}
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			lines = append(lines, line{' ', x[i]})
+			i++
+			j++
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, line{'-', x[i]})
+			i++
+		default:
+			lines = append(lines, line{'+', y[j]})
+			j++
+		}
+	}
+
+	// Changed lines with context
+	const context = 2
+	diff := &strings.Builder{}
+	last := -1
+	for n, l := range lines {
+		near := false
+		for k := n - context; k <= n+context; k++ {
+			if k >= 0 && k < len(lines) && lines[k].op != ' ' {
+				near = true
+				break
+			}
+		}
+		if !near {
+			continue
+		}
+		if last >= 0 && n != last+1 {
+			diff.WriteString("  ...\n")
+		}
+		fmt.Fprintf(diff, "%c %s\n", l.op, l.text)
+		last = n
+	}
+	return diff.String()
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"testing"
+
+	"k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// assertReadOnly - Only reads in dry-run mode. Fake clientset ignores DryRun of DeleteOptions, so deletes aren't allowed either.
+func assertReadOnly(t *testing.T, clientset *fake.Clientset) {
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() != "get" && action.GetVerb() != "list" {
+			t.Errorf("unexpected %s %s in dry-run mode", action.GetVerb(), action.GetResource().Resource)
+		}
+	}
+	clientset.ClearActions()
+}
+
+func TestControllerDryRun(t *testing.T) {
+	controller, clientset := newTestController(t, newTestConfig())
+	settings := newTestSettings("supersecret")
+	settings.PublicPaths = []string{"/healthz"}
+	source := newTestIngress("supersecret", nil)
+	source.Spec.Rules = []v1beta1.IngressRule{{
+		Host: "supersecret.example.com",
+		IngressRuleValue: v1beta1.IngressRuleValue{HTTP: &v1beta1.HTTPIngressRuleValue{
+			Paths: []v1beta1.HTTPIngressPath{{Path: "/", Backend: v1beta1.IngressBackend{ServiceName: "supersecret", ServicePort: intstr.FromInt(80)}}},
+		}},
+	}}
+
+	// Nothing is written, public Ingress is reported with the app
+	controller.DryRun = true
+	controller.ApplyIngress(source, settings)
+	assertReadOnly(t, clientset)
+	if controller.report.Create != 6 {
+		t.Errorf("report = %s, want 6 to create", controller.report)
+	}
+
+	controller.DryRun = false
+	controller.ApplyIngress(source, settings)
+
+	// Only changed objects are reported
+	controller.DryRun = true
+	clientset.ClearActions()
+	settings.Deployment.Replicas = int32Ptr(3)
+	controller.ApplyIngress(source, settings)
+	assertReadOnly(t, clientset)
+	if want := (dryRunReport{Update: 1, Unchanged: 5}); controller.report != want {
+		t.Errorf("report = %s, want %s", controller.report, want)
+	}
+	deployment, err := clientset.AppsV1beta2().Deployments("oauth2-proxy").Get("oauth2-proxy-github-example-corp-supersecret", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *deployment.Spec.Replicas != 1 {
+		t.Errorf("replicas = %d, want 1 (not updated)", *deployment.Spec.Replicas)
+	}
+
+	// Existing objects are reported, and kept
+	clientset.ClearActions()
+	controller.Delete(settings)
+	assertReadOnly(t, clientset)
+	if controller.report.Delete != 5 {
+		t.Errorf("report = %s, want 5 to delete", controller.report)
+	}
+	if _, err := clientset.AppsV1beta2().Deployments("oauth2-proxy").Get("oauth2-proxy-github-example-corp-supersecret", metav1.GetOptions{}); err != nil {
+		t.Errorf("Deployment should be kept in dry-run mode: %s", err)
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	if diff := lineDiff("a\nb\n", "a\nb\n"); diff != "" {
+		t.Errorf("equal input should have no diff, got %q", diff)
+	}
+	got := lineDiff("a\nb\nc\nd\ne\nf\n", "a\nb\nc\nd\nE\nf\n")
+	want := "  c\n  d\n- e\n+ E\n  f\n"
+	if got != want {
+		t.Errorf("lineDiff = %q, want %q", got, want)
+	}
+}
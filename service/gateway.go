@@ -0,0 +1,120 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/Laica-Lunasys/oauth2-proxy-manager/models"
+	"github.com/sirupsen/logrus"
+)
+
+// httpRouteResource - Gateway API HTTPRoute
+var httpRouteResource = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1", Resource: "httproutes"}
+
+// parseGateway - "<namespace>/<name>" of Gateway
+func parseGateway(value string) (string, string, error) {
+	kv := strings.SplitN(value, "/", 2)
+	if len(kv) != 2 || len(validation.IsDNS1123Label(kv[0])) != 0 || len(validation.IsDNS1123Subdomain(kv[1])) != 0 {
+		return "", "", fmt.Errorf("gateway %q is invalid: must be <namespace>/<name>", value)
+	}
+	return kv[0], kv[1], nil
+}
+
+// gatewayEnabled - Whether oauth2_proxy is served by HTTPRoute attached to Gateway, instead of Ingress
+func (c *Controller) gatewayEnabled() bool {
+	return len(c.Ingress.Gateway) != 0
+}
+
+// newHTTPRoute - HTTPRoute serving the app on its auth host. TLS is terminated by listener of the Gateway.
+func (c *Controller) newHTTPRoute(settings *models.ServiceSettings) *unstructured.Unstructured {
+	namespace, name, _ := parseGateway(c.Ingress.Gateway)
+	route := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": httpRouteResource.GroupVersion().String(),
+		"kind":       "HTTPRoute",
+		"metadata": map[string]interface{}{
+			"name":      proxyName(settings),
+			"namespace": "oauth2-proxy",
+		},
+		"spec": map[string]interface{}{
+			"parentRefs": []interface{}{
+				map[string]interface{}{"namespace": namespace, "name": name},
+			},
+			"hostnames": []interface{}{c.authHost(settings)},
+			"rules": []interface{}{
+				map[string]interface{}{
+					"matches": []interface{}{
+						map[string]interface{}{
+							"path": map[string]interface{}{
+								"type":  "PathPrefix",
+								"value": proxyPath(settings),
+							},
+						},
+					},
+					"backendRefs": []interface{}{
+						map[string]interface{}{"name": proxyName(settings), "port": int64(80)},
+					},
+				},
+			},
+		},
+	}}
+	route.SetLabels(c.Instance.labels())
+	return route
+}
+
+func (c *Controller) applyHTTPRoute(settings *models.ServiceSettings) {
+	if c.Dynamic == nil {
+		logrus.Panic("HTTPRoute can't be applied without dynamic client")
+	}
+	routeClient := c.Dynamic.Resource(httpRouteResource).Namespace("oauth2-proxy")
+	route := c.newHTTPRoute(settings)
+
+	logrus.Printf("[oauth2_proxy] Check HTTPRoute...")
+	result, err := routeClient.Get(route.GetName(), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		logrus.Panic(err)
+	}
+	if apierrors.IsNotFound(err) {
+		if c.dryRun("HTTPRoute", nil, route) {
+			return
+		}
+		logrus.Printf("[oauth2_proxy] Creating HTTPRoute...")
+		result, err = routeClient.Create(route, metav1.CreateOptions{})
+		if err != nil {
+			logrus.Panic(err)
+		}
+		logrus.Printf("[oauth2_proxy] Created HTTPRoute! %q", result.GetName())
+	} else {
+		if c.dryRun("HTTPRoute", result, route) {
+			return
+		}
+		logrus.Printf("[oauth2_proxy] Update HTTPRoute...")
+		route.SetResourceVersion(result.GetResourceVersion())
+		result, err = routeClient.Update(route, metav1.UpdateOptions{})
+		if err != nil {
+			logrus.Panic(err)
+		}
+		logrus.Printf("[oauth2_proxy] Updated HTTPRoute! %q", result.GetName())
+	}
+}
+
+// deleteHTTPRoute - Delete HTTPRoute of the app.
+// Without Gateway, clusters lacking Gateway API (or permission to it) have nothing to delete.
+func (c *Controller) deleteHTTPRoute(settings *models.ServiceSettings) {
+	if c.Dynamic == nil {
+		return
+	}
+	routeClient := c.Dynamic.Resource(httpRouteResource).Namespace("oauth2-proxy")
+	c.deleteObject("HTTPRoute", "oauth2-proxy", proxyName(settings), func(name string, options *metav1.DeleteOptions) error {
+		err := routeClient.Delete(name, options)
+		if apierrors.IsForbidden(err) && !c.gatewayEnabled() {
+			return apierrors.NewNotFound(httpRouteResource.GroupResource(), name)
+		}
+		return err
+	})
+}
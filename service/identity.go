@@ -0,0 +1,94 @@
+package service
+
+import (
+	"reflect"
+	"strings"
+
+	"k8s.io/api/extensions/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/Laica-Lunasys/oauth2-proxy-manager/models"
+	"github.com/sirupsen/logrus"
+)
+
+// appliedAppKey - Annotation of the source Ingress recording the app last applied for it ("<github-org>/<app-name>").
+// Annotations of the Ingress may change while the manager is down; the recorded app is removed on rename.
+const appliedAppKey = "applied-app"
+
+// appliedIdentity - App last applied for the Ingress. nil if not recorded.
+func (ob *Observer) appliedIdentity(ingress *v1beta1.Ingress) *models.ServiceSettings {
+	value, ok := annotationLookup(ingress.Annotations, ob.Controller.Instance.AnnotationPrefix)(appliedAppKey)
+	if !ok {
+		return nil
+	}
+	kv := strings.SplitN(value, "/", 2)
+	if len(kv) != 2 || len(validateGitHubOrg(kv[0])) != 0 || len(validateAppName(kv[1])) != 0 {
+		logrus.Warnf("[Observer] Ingress %s/%s: %s %q is invalid. ignored.", ingress.Namespace, ingress.Name, appliedAppKey, value)
+		return nil
+	}
+	return &models.ServiceSettings{
+		Instance: ob.Controller.Instance.Name,
+		AppName:  kv[1],
+		GitHub: models.GitHubProvider{
+			Organization: kv[0],
+		},
+	}
+}
+
+// recordIdentity - Record the app applied for the Ingress. nil removes the record.
+// Needs update permission of Ingresses; without it, only renames seen while running are handled.
+func (ob *Observer) recordIdentity(ingress *v1beta1.Ingress, settings *models.ServiceSettings) {
+	if ob.Controller.DryRun {
+		return
+	}
+	key := ob.Controller.Instance.AnnotationPrefix + "/" + appliedAppKey
+	value := ""
+	if settings != nil {
+		value = settings.GitHub.Organization + "/" + settings.AppName
+	}
+	if current, ok := ingress.Annotations[key]; (settings == nil && !ok) || (settings != nil && current == value) {
+		return
+	}
+
+	ingressClient := ob.Clientset.ExtensionsV1beta1().Ingresses(ingress.Namespace)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		result, err := ingressClient.Get(ingress.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if settings == nil {
+			delete(result.Annotations, key)
+		} else {
+			if result.Annotations == nil {
+				result.Annotations = map[string]string{}
+			}
+			result.Annotations[key] = value
+		}
+		_, err = ingressClient.Update(result)
+		return err
+	})
+	if err != nil && !apierrors.IsNotFound(err) {
+		// Without the record, rename while the manager is down leaves the old app
+		logrus.Warnf("[Observer] Failed to record %s of Ingress %s/%s: %s", appliedAppKey, ingress.Namespace, ingress.Name, err)
+	}
+}
+
+// identityRecorded - Whether the update of Ingress only records the applied app, nothing to apply then
+func (ob *Observer) identityRecorded(old, new *v1beta1.Ingress) bool {
+	key := ob.Controller.Instance.AnnotationPrefix + "/" + appliedAppKey
+	if old.Annotations[key] == new.Annotations[key] {
+		return false
+	}
+	others := func(annotations map[string]string) map[string]string {
+		m := map[string]string{}
+		for k, v := range annotations {
+			if k != key {
+				m[k] = v
+			}
+		}
+		return m
+	}
+	return reflect.DeepEqual(others(old.Annotations), others(new.Annotations))
+}
@@ -0,0 +1,370 @@
+package service
+
+import (
+	"sort"
+	"strings"
+
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/Laica-Lunasys/oauth2-proxy-manager/models"
+	"github.com/sirupsen/logrus"
+)
+
+// Ingress modes
+const (
+	// IngressModeShared - All apps are paths of single "oauth2-proxy" Ingress
+	IngressModeShared = "shared"
+	// IngressModePerApp - Each app has its own Ingress
+	IngressModePerApp = "per-app"
+)
+
+// defaultSharedIngressName - Name of the Ingress in shared mode, for default instance
+const defaultSharedIngressName = "oauth2-proxy"
+
+// sharedIngressName - Name of the Ingress in shared mode of this instance, for apps protected by the controller.
+// Apps protected by nginx keep "oauth2-proxy"; others get "oauth2-proxy-<controller>".
+func (c *Controller) sharedIngressName(controller string) string {
+	if controller == IngressControllerNginx {
+		return c.Instance.objectName(defaultSharedIngressName)
+	}
+	return c.Instance.objectName(defaultSharedIngressName + "-" + controller)
+}
+
+// ingressRoute - Where the app is served on auth host
+type ingressRoute struct {
+	Host          string
+	TLSSecretName string
+	Path          extensionsv1beta1.HTTPIngressPath
+}
+
+// applyIngress - Serve oauth2_proxy of the app on its auth host: by HTTPRoute with Gateway, otherwise by Ingress of the mode
+func (c *Controller) applyIngress(settings *models.ServiceSettings) {
+	if c.gatewayEnabled() {
+		c.applyHTTPRoute(settings)
+
+		// Migrate from Ingress
+		c.deleteIngress(settings)
+		return
+	}
+	// Migrate from HTTPRoute
+	c.deleteHTTPRoute(settings)
+
+	controller := appIngressAdapter(settings).Name()
+	if c.Ingress.Mode == IngressModePerApp {
+		c.applyAppIngress(settings)
+
+		// Migrate from shared Ingress
+		for _, adapter := range ingressAdapters {
+			c.deleteIngressPath(settings, adapter.Name())
+		}
+		return
+	}
+	c.applySharedIngress(settings)
+
+	// Migrate from per-app Ingress, and shared Ingress of other controllers
+	c.deleteObject("Ingress", "oauth2-proxy", proxyName(settings), c.Clientset.ExtensionsV1beta1().Ingresses("oauth2-proxy").Delete)
+	for _, adapter := range ingressAdapters {
+		if adapter.Name() != controller {
+			c.deleteIngressPath(settings, adapter.Name())
+		}
+	}
+}
+
+// deleteIngress - Remove the app from Ingress in any mode
+func (c *Controller) deleteIngress(settings *models.ServiceSettings) {
+	for _, adapter := range ingressAdapters {
+		c.deleteIngressPath(settings, adapter.Name())
+	}
+	c.deleteObject("Ingress", "oauth2-proxy", proxyName(settings), c.Clientset.ExtensionsV1beta1().Ingresses("oauth2-proxy").Delete)
+}
+
+// authHost - Host serving oauth2_proxy of the app (annotation > global)
+func (c *Controller) authHost(settings *models.ServiceSettings) string {
+	if len(settings.AuthHost) != 0 {
+		return settings.AuthHost
+	}
+	return c.Env.Domain
+}
+
+// ingressRoute - Route of the app on its auth host
+func (c *Controller) ingressRoute(settings *models.ServiceSettings) ingressRoute {
+	return ingressRoute{
+		Host:          c.authHost(settings),
+		TLSSecretName: settings.AuthTLSSecretName,
+		Path: extensionsv1beta1.HTTPIngressPath{
+			Path: proxyPath(settings),
+			Backend: extensionsv1beta1.IngressBackend{
+				ServiceName: proxyName(settings),
+				ServicePort: intstr.FromInt(80),
+			},
+		},
+	}
+}
+
+// newIngress - Ingress serving given routes, with a rule and TLS entry for each distinct host.
+// Served by the controller protecting the apps, unless INGRESS_CLASS is set.
+func (c *Controller) newIngress(name string, controller string, routes []ingressRoute) *extensionsv1beta1.Ingress {
+	ingress := &extensionsv1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "oauth2-proxy",
+			Labels:    c.Instance.labels(),
+			Annotations: map[string]string{
+				"kubernetes.io/ingress.class": controller,
+			},
+		},
+	}
+
+	if len(c.Ingress.IngressClass) != 0 {
+		ingress.Annotations["kubernetes.io/ingress.class"] = c.Ingress.IngressClass
+	}
+
+	// cert-manager issues certificates of TLS entries
+	if len(c.Ingress.ClusterIssuer) != 0 {
+		ingress.Annotations["cert-manager.io/cluster-issuer"] = c.Ingress.ClusterIssuer
+	} else if len(c.Ingress.Issuer) != 0 {
+		ingress.Annotations["cert-manager.io/issuer"] = c.Ingress.Issuer
+	}
+
+	paths := map[string][]extensionsv1beta1.HTTPIngressPath{}
+	secrets := map[string]string{}
+	for _, route := range routes {
+		paths[route.Host] = append(paths[route.Host], route.Path)
+		if len(route.TLSSecretName) != 0 {
+			secrets[route.Host] = route.TLSSecretName
+		}
+	}
+
+	hosts := []string{}
+	for host := range paths {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	for _, host := range hosts {
+		sort.Slice(paths[host], func(i, j int) bool { return paths[host][i].Path < paths[host][j].Path })
+		ingress.Spec.Rules = append(ingress.Spec.Rules, extensionsv1beta1.IngressRule{
+			Host: host,
+			IngressRuleValue: extensionsv1beta1.IngressRuleValue{
+				HTTP: &extensionsv1beta1.HTTPIngressRuleValue{
+					Paths: paths[host],
+				},
+			},
+		})
+	}
+
+	ingress.Spec.TLS = c.ingressTLS(name, hosts, secrets)
+	return ingress
+}
+
+// ingressTLS - TLS entries for hosts.
+// With cert-manager, every host gets a certificate (secret of its routes, or "<host>-tls", "<ingress>-tls" in per-app mode).
+// Otherwise TLS_HOSTS are served by TLS_SECRET_NAME, other hosts by the secret of their routes.
+func (c *Controller) ingressTLS(name string, hosts []string, secrets map[string]string) []extensionsv1beta1.IngressTLS {
+	tlsHosts := map[string][]string{}
+	if c.certManagerEnabled() {
+		for _, host := range hosts {
+			secret, ok := secrets[host]
+			if !ok && c.Ingress.Mode == IngressModePerApp {
+				// Ingresses of apps on the same host would claim one Certificate
+				secret = name + "-tls"
+			} else if !ok {
+				secret = certificateSecretName(host)
+			}
+			tlsHosts[secret] = append(tlsHosts[secret], host)
+		}
+	} else {
+		covered := map[string]bool{}
+		if len(c.Ingress.TLSHosts) != 0 && len(c.Ingress.TLSSecretName) != 0 {
+			for _, host := range strings.Split(c.Ingress.TLSHosts, ",") {
+				tlsHosts[c.Ingress.TLSSecretName] = append(tlsHosts[c.Ingress.TLSSecretName], host)
+				covered[host] = true
+			}
+		}
+		for _, host := range hosts {
+			if secret, ok := secrets[host]; ok && !covered[host] {
+				tlsHosts[secret] = append(tlsHosts[secret], host)
+			}
+		}
+	}
+
+	names := []string{}
+	for name := range tlsHosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var tls []extensionsv1beta1.IngressTLS
+	for _, name := range names {
+		tls = append(tls, extensionsv1beta1.IngressTLS{
+			Hosts:      tlsHosts[name],
+			SecretName: name,
+		})
+	}
+	return tls
+}
+
+func (c *Controller) certManagerEnabled() bool {
+	return len(c.Ingress.ClusterIssuer) != 0 || len(c.Ingress.Issuer) != 0
+}
+
+// certificateSecretName - "auth.example.com" => "auth-example-com-tls"
+func certificateSecretName(host string) string {
+	return strings.Replace(strings.TrimPrefix(host, "*."), ".", "-", -1) + "-tls"
+}
+
+// existingRoutes - Routes in existing Ingress except given path.
+// With exceptService, only the path served by the service is excepted (path of renamed app may be served by the new one).
+func existingRoutes(ingress *extensionsv1beta1.Ingress, exceptPath string, exceptService string) []ingressRoute {
+	secrets := map[string]string{}
+	for _, tls := range ingress.Spec.TLS {
+		for _, host := range tls.Hosts {
+			secrets[host] = tls.SecretName
+		}
+	}
+
+	routes := []ingressRoute{}
+	for _, rule := range ingress.Spec.Rules {
+		if rule.IngressRuleValue.HTTP == nil {
+			continue
+		}
+		for _, existPath := range rule.IngressRuleValue.HTTP.Paths {
+			if existPath.Path == exceptPath && (len(exceptService) == 0 || existPath.Backend.ServiceName == exceptService) {
+				continue
+			}
+			routes = append(routes, ingressRoute{
+				Host:          rule.Host,
+				TLSSecretName: secrets[rule.Host],
+				Path:          existPath,
+			})
+		}
+	}
+	return routes
+}
+
+func (c *Controller) applyAppIngress(settings *models.ServiceSettings) {
+	ingressClient := c.Clientset.ExtensionsV1beta1().Ingresses("oauth2-proxy")
+	ingress := c.newIngress(proxyName(settings), appIngressAdapter(settings).Name(), []ingressRoute{c.ingressRoute(settings)})
+
+	logrus.Printf("[oauth2_proxy] Check Ingress...")
+	result, err := ingressClient.Get(proxyName(settings), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		logrus.Panic(err)
+	}
+	if apierrors.IsNotFound(err) {
+		if c.dryRun("Ingress", nil, ingress) {
+			return
+		}
+		logrus.Printf("[oauth2_proxy] Creating Ingress...")
+		result, err = ingressClient.Create(ingress)
+		if err != nil {
+			logrus.Panic(err)
+		}
+		logrus.Printf("[oauth2_proxy] Created Ingress! %q", result.GetObjectMeta().GetName())
+	} else {
+		if c.dryRun("Ingress", result, ingress) {
+			return
+		}
+		logrus.Printf("[oauth2_proxy] Update Ingress...")
+		ingress.SetResourceVersion(result.GetResourceVersion())
+		result, err = ingressClient.Update(ingress)
+		if err != nil {
+			logrus.Panic(err)
+		}
+		logrus.Printf("[oauth2_proxy] Updated Ingress! %q", result.GetObjectMeta().GetName())
+	}
+}
+
+func (c *Controller) applySharedIngress(settings *models.ServiceSettings) {
+	ingressClient := c.Clientset.ExtensionsV1beta1().Ingresses("oauth2-proxy")
+	route := c.ingressRoute(settings)
+	controller := appIngressAdapter(settings).Name()
+	name := c.sharedIngressName(controller)
+
+	// Read-modify-write with ResourceVersion, retried when other writer wins.
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		result, err := ingressClient.Get(name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			ingress := c.newIngress(name, controller, []ingressRoute{route})
+			if c.dryRun("Ingress", nil, ingress) {
+				return nil
+			}
+			logrus.Printf("[oauth2_proxy] Creating Ingress...")
+			result, err = ingressClient.Create(ingress)
+			if apierrors.IsAlreadyExists(err) {
+				return apierrors.NewConflict(extensionsv1beta1.Resource("ingresses"), name, err)
+			} else if err != nil {
+				return err
+			}
+			logrus.Printf("[oauth2_proxy] Created Ingress! %q", result.GetObjectMeta().GetName())
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// Keep routes of other apps
+		routes := append(existingRoutes(result, route.Path.Path, ""), route)
+		ingress := c.newIngress(name, controller, routes)
+		if c.dryRun("Ingress", result, ingress) {
+			return nil
+		}
+
+		logrus.Printf("[oauth2_proxy] Update Ingress...")
+		ingress.SetResourceVersion(result.GetResourceVersion())
+		result, err = ingressClient.Update(ingress)
+		if err != nil {
+			return err
+		}
+		logrus.Printf("[oauth2_proxy] Updated Ingress! %q", result.GetObjectMeta().GetName())
+		return nil
+	})
+	if err != nil {
+		logrus.Panic(err)
+	}
+}
+
+// deleteIngressPath - Remove the app path from shared Ingress of the controller. Ingress without paths is deleted.
+func (c *Controller) deleteIngressPath(settings *models.ServiceSettings, controller string) {
+	ingressClient := c.Clientset.ExtensionsV1beta1().Ingresses("oauth2-proxy")
+	path := c.ingressRoute(settings).Path.Path
+	name := c.sharedIngressName(controller)
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		result, err := ingressClient.Get(name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		routes := existingRoutes(result, path, proxyName(settings))
+		if len(routes) == len(existingRoutes(result, "", "")) {
+			// Not found
+			return nil
+		}
+
+		if len(routes) == 0 {
+			// Paths added since Get are kept: Conflict reads the Ingress again
+			return c.deleteObjectAt("Ingress", "oauth2-proxy", name, result.GetResourceVersion(), ingressClient.Delete)
+		}
+		ingress := c.newIngress(name, controller, routes)
+		if c.dryRun("Ingress", result, ingress) {
+			return nil
+		}
+		logrus.Printf("[oauth2_proxy] Remove %s from Ingress...", path)
+		ingress.SetResourceVersion(result.GetResourceVersion())
+		result, err = ingressClient.Update(ingress)
+		if err != nil {
+			return err
+		}
+		logrus.Printf("[oauth2_proxy] Updated Ingress! %q", result.GetObjectMeta().GetName())
+		return nil
+	})
+	if err != nil {
+		logrus.Panic(err)
+	}
+}
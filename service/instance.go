@@ -0,0 +1,54 @@
+package service
+
+// DefaultAnnotationPrefix - Prefix of annotations read by the manager (e.g. oauth2-proxy-manager.k8s.io/app-name)
+const DefaultAnnotationPrefix = "oauth2-proxy-manager.k8s.io"
+
+// Labels of generated objects
+const (
+	managedByLabel = "app.kubernetes.io/managed-by"
+	instanceLabel  = "oauth2-proxy-manager.k8s.io/instance"
+)
+
+// InstanceOption - Identity of this manager, to run multiple managers in a cluster
+type InstanceOption struct {
+	// Name - Instance name, part of generated object names. Empty is the default instance.
+	Name string
+	// AnnotationPrefix - Only Ingresses annotated with this prefix are claimed
+	AnnotationPrefix string
+	// IngressControllers - Only Ingresses of these controllers are claimed. Empty is nginx.
+	IngressControllers []string
+}
+
+// ingressAdapter - Adapter of ingress.class claimed by this instance. nil if not claimed.
+func (o InstanceOption) ingressAdapter(class string) IngressAdapter {
+	controllers := o.IngressControllers
+	if len(controllers) == 0 {
+		controllers = []string{IngressControllerNginx}
+	}
+	for _, controller := range controllers {
+		if controller == class {
+			return lookupIngressAdapter(class)
+		}
+	}
+	return nil
+}
+
+// objectName - "oauth2-proxy" => "oauth2-proxy-<instance>"
+func (o InstanceOption) objectName(base string) string {
+	if len(o.Name) == 0 {
+		return base
+	}
+	return base + "-" + o.Name
+}
+
+// labels - Labels of generated objects
+func (o InstanceOption) labels() map[string]string {
+	name := o.Name
+	if len(name) == 0 {
+		name = "default"
+	}
+	return map[string]string{
+		managedByLabel: "oauth2-proxy-manager",
+		instanceLabel:  name,
+	}
+}
@@ -2,7 +2,10 @@ package service
 
 import (
 	"errors"
+	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
@@ -13,131 +16,574 @@ import (
 	"github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/api/extensions/v1beta1"
-	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/tools/cache"
 )
 
 type Observer struct {
-	Clientset  *kubernetes.Clientset
+	Clientset  kubernetes.Interface
 	Controller *Controller
+
+	// Namespaces - Observed namespaces. Empty means all namespaces.
+	Namespaces []string
+	// IngressSelector - Labels of observed Ingresses
+	IngressSelector labels.Selector
+	// NamespaceSelector - Labels of namespaces of observed Ingresses. nil means every namespace.
+	NamespaceSelector labels.Selector
+	// ResyncPeriod - Interval to apply every observed Ingress again. 0 disables.
+	ResyncPeriod time.Duration
+
+	stores      []cache.Store
+	routeStores []cache.Store
+	informers   []cache.Controller
+	namespaces  cache.Store
+
+	// mu - Serializes apply / remove, so that late events of generated objects don't bring back removed apps
+	mu sync.Mutex
+	// sources - Applied apps by oauth2_proxy name and source (e.g. "Ingress default/example"), to find owners of generated objects. Guarded by mu.
+	sources map[string]map[string]*models.ServiceSettings
+	// sourceProxies - oauth2_proxy name of the app applied for each source. Guarded by mu.
+	sourceProxies map[string]string
 }
 
-func NewObserver(clientset *kubernetes.Clientset, controller *Controller) (*Observer, error) {
+func NewObserver(clientset kubernetes.Interface, controller *Controller, cfg *Config) (*Observer, error) {
 	observer := &Observer{
-		Clientset:  clientset,
-		Controller: controller,
+		Clientset:    clientset,
+		Controller:   controller,
+		Namespaces:   cfg.watchNamespaces(),
+		ResyncPeriod: cfg.resyncPeriod(),
+	}
+
+	var err error
+	if observer.IngressSelector, err = labels.Parse(cfg.IngressSelector); err != nil {
+		return nil, err
+	}
+	if len(cfg.NamespaceSelector) != 0 {
+		if observer.NamespaceSelector, err = labels.Parse(cfg.NamespaceSelector); err != nil {
+			return nil, err
+		}
+	}
+
+	// create resource watcher (ingress) for each namespace, so namespaced RBAC is enough
+	namespaces := observer.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{v1.NamespaceAll}
+	}
+	for _, namespace := range namespaces {
+		store, informer := cache.NewInformer(observer.ingressWatcher(namespace), &v1beta1.Ingress{}, observer.ResyncPeriod, observer.ingressHandler())
+		observer.stores = append(observer.stores, store)
+		observer.informers = append(observer.informers, informer)
 	}
+
+	// HTTPRoutes, with Gateway API
+	if len(cfg.Gateway) != 0 {
+		if controller.Dynamic == nil {
+			return nil, errors.New("gateway: HTTPRoutes can't be observed without dynamic client")
+		}
+		for _, namespace := range namespaces {
+			store, informer := cache.NewInformer(observer.routeWatcher(namespace), &unstructured.Unstructured{}, observer.ResyncPeriod, observer.routeHandler())
+			observer.routeStores = append(observer.routeStores, store)
+			observer.informers = append(observer.informers, informer)
+		}
+	}
+
+	// Namespace labels, to select Ingresses by namespace
+	if observer.NamespaceSelector != nil {
+		store, informer := cache.NewInformer(&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return clientset.CoreV1().Namespaces().List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return clientset.CoreV1().Namespaces().Watch(options)
+			},
+		}, &v1.Namespace{}, 0, observer.namespaceHandler())
+		observer.namespaces = store
+		observer.informers = append(observer.informers, informer)
+	}
+
+	// Generated objects, to correct drift
+	observer.childWatchers()
 	return observer, nil
 }
 
-func (ob *Observer) Run() {
-	logrus.Info("[Observer] Observing Ingress...")
-
-	// create resource watcher (ingress)
-	watcher := cache.NewListWatchFromClient(ob.Clientset.ExtensionsV1beta1().RESTClient(), "ingresses", v1.NamespaceAll, fields.Everything())
+func (ob *Observer) ingressWatcher(namespace string) *cache.ListWatch {
+	selector := ob.IngressSelector.String()
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = selector
+			return ob.Clientset.ExtensionsV1beta1().Ingresses(namespace).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = selector
+			return ob.Clientset.ExtensionsV1beta1().Ingresses(namespace).Watch(options)
+		},
+	}
+}
 
-	_, controller := cache.NewInformer(watcher, &v1beta1.Ingress{}, 0, cache.ResourceEventHandlerFuncs{
+func (ob *Observer) ingressHandler() cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			key, err := cache.MetaNamespaceKeyFunc(obj)
 			if err == nil {
-				meta := obj.(*v1beta1.Ingress).ObjectMeta
-				logrus.Infof("[Informer] Added Ingress %s", key)
-
-				settings, err := parseAnnotations(meta)
-				if err == nil {
-					ob.Controller.Apply(settings)
-					//logrus.WithField("settings", settings).Info("Dummy: Update Deployment / ConfigMap / Service / Secret / Ingress")
+				ingress := obj.(*v1beta1.Ingress)
+				if !ob.namespaceSelected(ingress.Namespace) {
+					return
 				}
+				logrus.Infof("[Informer] Added Ingress %s", key)
+				ob.apply(key, ingress)
 			}
 		},
 		UpdateFunc: func(old interface{}, new interface{}) {
 			key, err := cache.MetaNamespaceKeyFunc(new)
-
 			if err == nil {
-				meta := new.(*v1beta1.Ingress).ObjectMeta
-				logrus.Infof("[Informer] Update Ingress %s", key)
-
-				settings, err := parseAnnotations(meta)
-				if err == nil {
-					ob.Controller.Apply(settings)
-					logrus.WithField("settings", settings).Info("Dummy: Update Deployment / ConfigMap / Service / Secret / Ingress")
+				ingress := new.(*v1beta1.Ingress)
+				if !ob.namespaceSelected(ingress.Namespace) {
+					return
 				}
+				if old.(*v1beta1.Ingress).ResourceVersion == ingress.ResourceVersion {
+					logrus.Debugf("[Informer] Resync Ingress %s", key)
+				} else {
+					logrus.Infof("[Informer] Update Ingress %s", key)
+				}
+				ob.update(key, old.(*v1beta1.Ingress), ingress)
 			}
 		},
 		DeleteFunc: func(obj interface{}) {
 			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
 			if err == nil {
-				meta := obj.(*v1beta1.Ingress).ObjectMeta
+				// Missed deletion event has final state in tombstone
+				if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+				ingress, ok := obj.(*v1beta1.Ingress)
+				if !ok || !ob.namespaceSelected(ingress.Namespace) {
+					return
+				}
 				logrus.Infof("[Informer] Delete Ingress: %s", key)
+				ob.remove(ingress)
+			}
+		},
+	}
+}
 
-				settings, err := parseAnnotations(meta)
-				if err == nil {
-					logrus.WithField("settings", settings).Info("Dummy: Delete Deployment / ConfigMap / Service / Secret / Ingress")
+// namespaceHandler - Apply / remove Ingresses of namespace entering / leaving NamespaceSelector
+func (ob *Observer) namespaceHandler() cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			namespace := obj.(*v1.Namespace)
+			if ob.NamespaceSelector.Matches(labels.Set(namespace.Labels)) {
+				logrus.Infof("[Informer] Namespace %s is selected", namespace.Name)
+				for _, ingress := range ob.ingresses(namespace.Name) {
+					ob.apply(ingress.Namespace+"/"+ingress.Name, ingress)
+				}
+				for _, route := range ob.routes(namespace.Name) {
+					ob.applyRoute(route.GetNamespace()+"/"+route.GetName(), route, nil)
 				}
 			}
 		},
-	})
+		UpdateFunc: func(old interface{}, new interface{}) {
+			before := ob.NamespaceSelector.Matches(labels.Set(old.(*v1.Namespace).Labels))
+			namespace := new.(*v1.Namespace)
+			after := ob.NamespaceSelector.Matches(labels.Set(namespace.Labels))
+			if before == after {
+				return
+			}
+			if after {
+				logrus.Infof("[Informer] Namespace %s is selected", namespace.Name)
+			} else {
+				logrus.Infof("[Informer] Namespace %s is not selected anymore", namespace.Name)
+			}
+			for _, ingress := range ob.ingresses(namespace.Name) {
+				if after {
+					ob.apply(ingress.Namespace+"/"+ingress.Name, ingress)
+				} else {
+					ob.remove(ingress)
+				}
+			}
+			for _, route := range ob.routes(namespace.Name) {
+				if after {
+					ob.applyRoute(route.GetNamespace()+"/"+route.GetName(), route, nil)
+				} else {
+					ob.removeRoute(route)
+				}
+			}
+		},
+	}
+}
+
+// namespaceSelected - Whether Ingresses in namespace are observed
+func (ob *Observer) namespaceSelected(name string) bool {
+	if ob.NamespaceSelector == nil {
+		return true
+	}
+	obj, exists, err := ob.namespaces.GetByKey(name)
+	if err != nil || !exists {
+		// Not known yet: applied when the namespace is added
+		return false
+	}
+	return ob.NamespaceSelector.Matches(labels.Set(obj.(*v1.Namespace).Labels))
+}
+
+// namespaceObserved - Whether objects in the namespace are observed (WATCH_NAMESPACES / NAMESPACE_SELECTOR)
+func (ob *Observer) namespaceObserved(name string) bool {
+	if len(ob.Namespaces) == 0 {
+		return ob.namespaceSelected(name)
+	}
+	for _, namespace := range ob.Namespaces {
+		if namespace == name {
+			return ob.namespaceSelected(name)
+		}
+	}
+	return false
+}
+
+// ingressObserved - Whether the Ingress is observed by this manager, as selected by its informers
+func (ob *Observer) ingressObserved(ingress *v1beta1.Ingress) bool {
+	return ob.IngressSelector.Matches(labels.Set(ingress.Labels)) && ob.namespaceObserved(ingress.Namespace)
+}
+
+// ingresses - Observed Ingresses in namespace (all namespaces if empty)
+func (ob *Observer) ingresses(namespace string) []*v1beta1.Ingress {
+	ingresses := []*v1beta1.Ingress{}
+	for _, store := range ob.stores {
+		for _, obj := range store.List() {
+			ingress, ok := obj.(*v1beta1.Ingress)
+			if ok && (len(namespace) == 0 || ingress.Namespace == namespace) {
+				ingresses = append(ingresses, ingress)
+			}
+		}
+	}
+	return ingresses
+}
+
+func (ob *Observer) apply(key string, ingress *v1beta1.Ingress) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	ob.reconcile(key, ingress, ob.appliedIdentity(ingress))
+}
+
+// update - Apply updated Ingress. App of old annotations is previous one, unless recorded in the Ingress.
+func (ob *Observer) update(key string, old, new *v1beta1.Ingress) {
+	if ob.identityRecorded(old, new) {
+		return
+	}
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	previous := ob.appliedIdentity(new)
+	if previous == nil {
+		previous, _ = parseIdentity(old.ObjectMeta, ob.Controller.Instance)
+	}
+	ob.reconcile(key, new, previous)
+}
+
+// reconcile - Apply the app of the Ingress. previous app applied for it is removed if the Ingress isn't claimed anymore
+// (e.g. app-name removed, ingress.class changed), or after the new one is applied if its name changes (app-name / github-org changed).
+// Invalid annotations keep previous oauth2_proxy running.
+func (ob *Observer) reconcile(key string, ingress *v1beta1.Ingress, previous *models.ServiceSettings) {
+	settings, err := parseAnnotations(ingress.ObjectMeta, ob.Controller.Instance)
+	if err != nil {
+		logAnnotationError("Ingress", key, err)
+		if _, invalid := err.(AnnotationError); previous != nil && !invalid {
+			logrus.Infof("[Observer] Ingress %s is not protected anymore (%s), removing oauth2_proxy(%s)", key, err, previous.AppName)
+			ob.Controller.Delete(previous)
+			ob.Controller.DeletePublicIngress(ingress)
+			ob.recordIdentity(ingress, nil)
+			ob.unindex("Ingress " + key)
+		}
+		return
+	}
+
+	if err := ob.Controller.ApplyIngress(ingress, settings); err != nil {
+		return
+	}
+	ob.checkSharedAuthURL(key, settings)
+	if previous != nil && proxyName(previous) != proxyName(settings) {
+		logrus.Infof("[Observer] Ingress %s is moved from %s to %s", key, proxyName(previous), proxyName(settings))
+		ob.Controller.Delete(previous)
+	}
+	ob.recordIdentity(ingress, settings)
+	ob.index("Ingress "+key, settings)
+}
+
+// remove - Remove oauth2_proxy of the Ingress, even if its annotations are invalid now
+func (ob *Observer) remove(ingress *v1beta1.Ingress) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	ob.unindex("Ingress " + ingress.Namespace + "/" + ingress.Name)
+	settings := ob.appliedIdentity(ingress)
+	if settings == nil {
+		var err error
+		if settings, err = parseIdentity(ingress.ObjectMeta, ob.Controller.Instance); err != nil {
+			return
+		}
+	}
+	ob.Controller.Delete(settings)
+	ob.Controller.DeletePublicIngress(ingress)
+}
+
+func (ob *Observer) Run() {
+	if len(ob.Namespaces) == 0 {
+		logrus.Info("[Observer] Observing Ingress...")
+	} else {
+		logrus.Infof("[Observer] Observing Ingress in %s...", strings.Join(ob.Namespaces, ", "))
+	}
 
 	// Now let's start the controller
 	stop := make(chan struct{})
 	defer close(stop)
-	go controller.Run(stop)
+	ob.start(stop)
 
 	// Wait forever
 	select {}
 }
 
-func parseAnnotations(meta metav1.ObjectMeta) (*models.ServiceSettings, error) {
-	// Check Annotations ---
-	if _, ok := meta.Annotations["kubernetes.io/ingress.class"]; !ok {
+func (ob *Observer) start(stop <-chan struct{}) {
+	for _, informer := range ob.informers {
+		go informer.Run(stop)
+	}
+}
+
+// Resync - Apply all observed Ingresses again (e.g. global settings changed)
+func (ob *Observer) Resync() {
+	for _, ingress := range ob.ingresses("") {
+		if !ob.namespaceSelected(ingress.Namespace) {
+			continue
+		}
+		logrus.Infof("[Observer] Resync Ingress %s/%s", ingress.Namespace, ingress.Name)
+		ob.apply(ingress.Namespace+"/"+ingress.Name, ingress)
+	}
+	for _, route := range ob.routes("") {
+		if !ob.namespaceSelected(route.GetNamespace()) {
+			continue
+		}
+		logrus.Infof("[Observer] Resync HTTPRoute %s/%s", route.GetNamespace(), route.GetName())
+		ob.applyRoute(route.GetNamespace()+"/"+route.GetName(), route, nil)
+	}
+}
+
+// logAnnotationError - Tell why the object (Ingress / HTTPRoute) is skipped. Object not for this manager is skipped silently.
+func logAnnotationError(kind string, key string, err error) {
+	if _, ok := err.(AnnotationError); ok {
+		logrus.Warnf("[Informer] %s %s: %s", kind, key, err)
+	}
+}
+
+// checkClaimed - Adapter of the controller if the Ingress is protected by this instance. Error tells why it is skipped.
+func checkClaimed(meta metav1.ObjectMeta, instance InstanceOption, lookup lookupFunc) (IngressAdapter, error) {
+	class, ok := meta.Annotations["kubernetes.io/ingress.class"]
+	if !ok {
 		return nil, errors.New("ingress.class not found. skip.")
-	} else if meta.Annotations["kubernetes.io/ingress.class"] != "nginx" {
-		// or ingress.class is "nginx" ?
-		return nil, errors.New("ingress.class is not nginx. skip.")
+	}
+	adapter := instance.ingressAdapter(class)
+	if adapter == nil {
+		return nil, fmt.Errorf("ingress.class %q is not handled by this instance. skip.", class)
 	}
 
-	if _, ok := meta.Annotations["nginx.ingress.kubernetes.io/auth-url"]; !ok {
-		return nil, errors.New("auth-url not found. skip.")
+	if err := adapter.checkAuth(meta.Annotations); err != nil {
+		return nil, err
+	}
+	if err := checkAppClaimed(lookup); err != nil {
+		return nil, err
 	}
+	return adapter, nil
+}
 
-	if _, ok := meta.Annotations["nginx.ingress.kubernetes.io/auth-signin"]; !ok {
-		return nil, errors.New("auth-signin not found. skip.")
+// checkAppClaimed - Whether the object has the annotations of an app of this instance (Ingress or HTTPRoute)
+func checkAppClaimed(lookup lookupFunc) error {
+	if _, ok := lookup("app-name"); !ok {
+		return errors.New("app-name not found. skip.")
 	}
 
-	if _, ok := meta.Annotations["oauth2-proxy-manager.k8s.io/app-name"]; !ok {
-		return nil, errors.New("app-name not found. skip.")
+	if _, ok := lookup("github-org"); !ok {
+		return errors.New("github-org not found. skip.")
 	}
 
-	if _, ok := meta.Annotations["oauth2-proxy-manager.k8s.io/github-org"]; !ok {
-		return nil, errors.New("github-org not found. skip.")
+	if _, ok := lookup("github-teams"); !ok {
+		return errors.New("github-teams not found. skip.")
 	}
+	return nil
+}
 
-	if _, ok := meta.Annotations["oauth2-proxy-manager.k8s.io/github-teams"]; !ok {
-		return nil, errors.New("github-teams not found. skip.")
+// parseIdentity - App claimed by the Ingress (instance, app-name, github-org), enough to remove its oauth2_proxy.
+// Unlike parseAnnotations, other annotations may be invalid.
+func parseIdentity(meta metav1.ObjectMeta, instance InstanceOption) (*models.ServiceSettings, error) {
+	lookup := annotationLookup(meta.Annotations, instance.AnnotationPrefix)
+	adapter, err := checkClaimed(meta, instance, lookup)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := parseAppIdentity(instance, lookup)
+	if err != nil {
+		return nil, err
 	}
+	settings.IngressController = adapter.Name()
+	return settings, nil
+}
 
-	setXAuthRequest, ok := meta.Annotations["oauth2-proxy-manager.k8s.io/set-xauthrequest"]
-	if !ok {
-		setXAuthRequest = ""
+// parseAppIdentity - instance, app-name, github-org of claimed object
+func parseAppIdentity(instance InstanceOption, lookup lookupFunc) (*models.ServiceSettings, error) {
+	appName, _ := lookup("app-name")
+	org, _ := lookup("github-org")
+	settings := &models.ServiceSettings{
+		Instance: instance.Name,
+		AppName:  strings.TrimSpace(appName),
+		GitHub: models.GitHubProvider{
+			Organization: strings.TrimSpace(org),
+		},
+	}
+
+	errs := AnnotationError{}
+	errs = append(errs, validateAppName(settings.AppName)...)
+	errs = append(errs, validateGitHubOrg(settings.GitHub.Organization)...)
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	return settings, nil
+}
+
+// parseAnnotations - Settings of the app from annotations with prefix of the instance.
+// Ingress without app-name of the prefix is left to other instances.
+func parseAnnotations(meta metav1.ObjectMeta, instance InstanceOption) (*models.ServiceSettings, error) {
+	lookup := annotationLookup(meta.Annotations, instance.AnnotationPrefix)
+	adapter, err := checkClaimed(meta, instance, lookup)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := parseAppSettings(instance, lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	// Traefik Middlewares are not read here: no API call while parsing
+	settings.IngressController = adapter.Name()
+	settings.AuthURL, settings.AuthSignIn, _ = adapter.authURLs(&v1beta1.Ingress{ObjectMeta: meta}, nil)
+	logrus.WithFields(logrus.Fields{
+		"ingress.class": meta.Annotations["kubernetes.io/ingress.class"],
+		"auth-url":      settings.AuthURL,
+		"auth-signin":   settings.AuthSignIn,
+	}).Debug("[ParseAnnotations]")
+	return settings, nil
+}
+
+// parseAppSettings - Settings of the app from annotations of claimed object, after validating every annotation
+func parseAppSettings(instance InstanceOption, lookup lookupFunc) (*models.ServiceSettings, error) {
+	annotation := func(key string) string {
+		value, _ := lookup(key)
+		return value
+	}
+
+	setXAuthRequest := annotation("set-xauthrequest")
+
+	// Validate every annotation, then report all problems at once
+	errs := AnnotationError{}
+
+	appName := strings.TrimSpace(annotation("app-name"))
+	errs = append(errs, validateAppName(appName)...)
+
+	org := strings.TrimSpace(annotation("github-org"))
+	errs = append(errs, validateGitHubOrg(org)...)
+
+	teams, teamErrs := parseGitHubTeams(annotation("github-teams"))
+	errs = append(errs, teamErrs...)
+
+	if len(errs) == 0 {
+		// Generated object names must be DNS label too (e.g. too long)
+		name := proxyName(&models.ServiceSettings{Instance: instance.Name, AppName: appName, GitHub: models.GitHubProvider{Organization: org}})
+		for _, msg := range validation.IsDNS1123Label(name) {
+			errs = append(errs, fmt.Sprintf("generated name %q is invalid: %s", name, msg))
+		}
+	}
+
+	if version, ok := lookup("version"); ok {
+		if _, err := lookupRelease(version); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	// Used in Ingress hosts and oauth2_proxy args
+	if authHost := annotation("auth-host"); strings.HasPrefix(authHost, ".") {
+		errs = append(errs, fmt.Sprintf("auth-host %q is invalid: must be host, not domain", authHost))
+	} else if len(authHost) != 0 {
+		errs = append(errs, validateDomain("auth-host", authHost)...)
+	}
+	if cookieDomain := annotation("cookie-domain"); len(cookieDomain) != 0 {
+		errs = append(errs, validateDomain("cookie-domain", cookieDomain)...)
+	}
+	if whitelistDomain := annotation("whitelist-domain"); len(whitelistDomain) != 0 {
+		for _, d := range strings.Split(whitelistDomain, ",") {
+			errs = append(errs, validateDomain("whitelist-domain", d)...)
+		}
+	}
+
+	if err := validateImageRepository("image", annotation("image")); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	deployment, err := parseDeploymentSettings(lookup)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	session, err := parseSessionStoreSettings(lookup)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	serviceType := ""
+	if value, ok := lookup("service-type"); ok {
+		if serviceType, err = parseServiceType(value); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	publicPaths, pathErrs := parsePublicPaths(annotation("public-paths"))
+	errs = append(errs, pathErrs...)
+
+	sharing := ""
+	if value, ok := lookup("sharing"); ok {
+		if sharing, err = parseProxySharing(value); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) != 0 {
+		return nil, errs
 	}
 
 	logrus.WithFields(logrus.Fields{
-		"ingress.class":    meta.Annotations["kubernetes.io/ingress.class"],
-		"auth-url":         meta.Annotations["nginx.ingress.kubernetes.io/auth-url"],
-		"auth-signin":      meta.Annotations["nginx.ingress.kubernetes.io/auth-signin"],
-		"github-org":       meta.Annotations["oauth2-proxy-manager.k8s.io/github-org"],
-		"github-teams":     meta.Annotations["oauth2-proxy-manager.k8s.io/github-teams"],
+		"app-name":         appName,
+		"github-org":       annotation("github-org"),
+		"github-teams":     annotation("github-teams"),
+		"auth-host":        annotation("auth-host"),
+		"cookie-domain":    annotation("cookie-domain"),
+		"whitelist-domain": annotation("whitelist-domain"),
 		"set-xauthrequest": setXAuthRequest,
+		"image":            annotation("image"),
+		"version":          annotation("version"),
 	}).Debug("[ParseAnnotations]")
 
 	settings := &models.ServiceSettings{
-		AppName:         meta.Annotations["oauth2-proxy-manager.k8s.io/app-name"],
-		AuthURL:         meta.Annotations["nginx.ingress.kubernetes.io/auth-url"],
-		AuthSignIn:      meta.Annotations["nginx.ingress.kubernetes.io/auth-signin"],
-		SetXAuthRequest: setXAuthRequest,
+		Instance:          instance.Name,
+		AppName:           appName,
+		AuthHost:          annotation("auth-host"),
+		AuthTLSSecretName: annotation("auth-tls-secret"),
+		CookieDomain:      annotation("cookie-domain"),
+		WhitelistDomain:   annotation("whitelist-domain"),
+		SetXAuthRequest:   setXAuthRequest,
+		Image:             annotation("image"),
+		Version:           annotation("version"),
+		ServiceType:       serviceType,
+		Sharing:           sharing,
+		PublicPaths:       publicPaths,
+		Deployment:        deployment,
+		SessionStore:      session,
 		GitHub: models.GitHubProvider{
-			Organization: meta.Annotations["oauth2-proxy-manager.k8s.io/github-org"],
-			Teams:        strings.Split(meta.Annotations["oauth2-proxy-manager.k8s.io/github-teams"], ","),
+			Organization: org,
+			Teams:        teams,
 		},
 	}
 
@@ -0,0 +1,507 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	appsv1beta2 "k8s.io/api/apps/v1beta2"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/api/extensions/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// startTestObserver - Observer fed by fake watcher. Events are delivered in the order they are sent.
+func startTestObserver(t *testing.T) (*fake.Clientset, *watch.FakeWatcher, chan struct{}) {
+	controller, clientset := newTestController(t, newTestConfig())
+	watcher := watch.NewFake()
+	clientset.PrependWatchReactor("ingresses", k8stesting.DefaultWatchReactor(watcher, nil))
+
+	observer, err := NewObserver(clientset, controller, newTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	observer.start(stop)
+	return clientset, watcher, stop
+}
+
+func newTestIngress(app string, annotations map[string]string) *v1beta1.Ingress {
+	ingress := &v1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      app,
+			Namespace: app,
+			Annotations: map[string]string{
+				"kubernetes.io/ingress.class":              "nginx",
+				"nginx.ingress.kubernetes.io/auth-url":     "https://auth.example.com/github/" + app + "/auth",
+				"nginx.ingress.kubernetes.io/auth-signin":  "https://auth.example.com/github/" + app + "/start",
+				"oauth2-proxy-manager.k8s.io/app-name":     app,
+				"oauth2-proxy-manager.k8s.io/github-org":   "example-corp",
+				"oauth2-proxy-manager.k8s.io/github-teams": "admin, dev",
+			},
+		},
+	}
+	for key, value := range annotations {
+		ingress.Annotations[key] = value
+	}
+	return ingress
+}
+
+// waitFor - Poll until cond is satisfied
+func waitFor(t *testing.T, what string, cond func() bool) {
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return cond(), nil
+	})
+	if err != nil {
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func deploymentReplicas(clientset *fake.Clientset, name string) int32 {
+	deployment, err := clientset.AppsV1beta2().Deployments("oauth2-proxy").Get(name, metav1.GetOptions{})
+	if err != nil || deployment.Spec.Replicas == nil {
+		return 0
+	}
+	return *deployment.Spec.Replicas
+}
+
+func TestObserverAddUpdateDelete(t *testing.T) {
+	clientset, watcher, stop := startTestObserver(t)
+	defer close(stop)
+	name := "oauth2-proxy-github-example-corp-supersecret"
+
+	watcher.Add(newTestIngress("supersecret", nil))
+	waitFor(t, "Deployment created", func() bool {
+		return deploymentReplicas(clientset, name) == 1
+	})
+	if paths := ingressPaths(t, clientset, defaultSharedIngressName); paths["auth.example.com/github/supersecret"] != name {
+		t.Errorf("Ingress paths = %v", paths)
+	}
+	deployment, _ := clientset.AppsV1beta2().Deployments("oauth2-proxy").Get(name, metav1.GetOptions{})
+	if args := deployment.Spec.Template.Spec.Containers[0].Args; !containsString(args, "--github-team=admin,dev") {
+		t.Errorf("teams are not trimmed: %v", args)
+	}
+
+	watcher.Modify(newTestIngress("supersecret", map[string]string{
+		"oauth2-proxy-manager.k8s.io/replicas": "2",
+	}))
+	waitFor(t, "Deployment updated", func() bool {
+		return deploymentReplicas(clientset, name) == 2
+	})
+
+	watcher.Delete(newTestIngress("supersecret", nil))
+	waitFor(t, "Deployment deleted", func() bool {
+		_, err := clientset.AppsV1beta2().Deployments("oauth2-proxy").Get(name, metav1.GetOptions{})
+		return apierrors.IsNotFound(err)
+	})
+	if paths := ingressPaths(t, clientset, defaultSharedIngressName); paths != nil {
+		t.Errorf("Ingress should be deleted, got %v", paths)
+	}
+}
+
+func TestObserverSkipsInvalidIngress(t *testing.T) {
+	clientset, watcher, stop := startTestObserver(t)
+	defer close(stop)
+
+	// Not for this manager
+	unmanaged := newTestIngress("unmanaged", nil)
+	delete(unmanaged.Annotations, "nginx.ingress.kubernetes.io/auth-url")
+	watcher.Add(unmanaged)
+
+	// Invalid annotations
+	watcher.Add(newTestIngress("invalid", map[string]string{
+		"oauth2-proxy-manager.k8s.io/github-teams": "admin,,dev",
+	}))
+
+	// Events are handled in order: after this one is applied, the others have been handled.
+	watcher.Add(newTestIngress("valid", nil))
+	waitFor(t, "Deployment created", func() bool {
+		return deploymentReplicas(clientset, "oauth2-proxy-github-example-corp-valid") == 1
+	})
+
+	deployments, err := clientset.AppsV1beta2().Deployments("oauth2-proxy").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deployments.Items) != 1 {
+		t.Errorf("only valid Ingress should be applied, got %d Deployments", len(deployments.Items))
+	}
+}
+
+func TestObserverScope(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.WatchNamespaces = "tenant-a, tenant-b"
+	cfg.IngressSelector = "oauth2-proxy=enabled"
+	cfg.NamespaceSelector = "tenant=x"
+	controller, clientset := newTestController(t, cfg)
+
+	for name, tenant := range map[string]string{"tenant-a": "x", "tenant-b": "y", "tenant-c": "x"} {
+		namespace := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"tenant": tenant}}}
+		if _, err := clientset.CoreV1().Namespaces().Create(namespace); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, ingress := range []*v1beta1.Ingress{
+		newTestIngress("tenant-a", nil),
+		newTestIngress("tenant-b", nil),
+		newTestIngress("tenant-c", nil),
+		newTestIngress("unlabeled", nil),
+	} {
+		if ingress.Name != "unlabeled" {
+			ingress.Labels = map[string]string{"oauth2-proxy": "enabled"}
+		} else {
+			ingress.Namespace = "tenant-a"
+		}
+		if _, err := clientset.ExtensionsV1beta1().Ingresses(ingress.Namespace).Create(ingress); err != nil {
+			t.Fatal(err)
+		}
+	}
+	namespaces := watch.NewFake()
+	clientset.PrependWatchReactor("namespaces", k8stesting.DefaultWatchReactor(namespaces, nil))
+
+	observer, err := NewObserver(clientset, controller, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	observer.start(stop)
+
+	waitFor(t, "tenant-a applied", func() bool {
+		return deploymentReplicas(clientset, "oauth2-proxy-github-example-corp-tenant-a") == 1
+	})
+	// tenant-b: namespace not selected, tenant-c: namespace not watched, unlabeled: Ingress not selected
+	for _, app := range []string{"tenant-b", "tenant-c", "unlabeled"} {
+		if deploymentReplicas(clientset, "oauth2-proxy-github-example-corp-"+app) != 0 {
+			t.Errorf("%s should not be applied", app)
+		}
+	}
+
+	// Namespace entering / leaving selector
+	namespaces.Modify(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "tenant-b", Labels: map[string]string{"tenant": "x"}}})
+	waitFor(t, "tenant-b applied", func() bool {
+		return deploymentReplicas(clientset, "oauth2-proxy-github-example-corp-tenant-b") == 1
+	})
+	namespaces.Modify(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "tenant-a", Labels: map[string]string{"tenant": "z"}}})
+	waitFor(t, "tenant-a removed", func() bool {
+		_, err := clientset.AppsV1beta2().Deployments("oauth2-proxy").Get("oauth2-proxy-github-example-corp-tenant-a", metav1.GetOptions{})
+		return apierrors.IsNotFound(err)
+	})
+}
+
+func TestObserverDriftCorrection(t *testing.T) {
+	controller, clientset := newTestController(t, newTestConfig())
+	watchers := map[string]*watch.FakeWatcher{}
+	for _, resource := range []string{"ingresses", "deployments", "services"} {
+		watchers[resource] = watch.NewFake()
+		clientset.PrependWatchReactor(resource, k8stesting.DefaultWatchReactor(watchers[resource], nil))
+	}
+	observer, err := NewObserver(clientset, controller, newTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	observer.start(stop)
+	name := "oauth2-proxy-github-example-corp-supersecret"
+
+	watchers["ingresses"].Add(newTestIngress("supersecret", nil))
+	waitFor(t, "Deployment created", func() bool {
+		return deploymentReplicas(clientset, name) == 1
+	})
+
+	// Hand-edited Deployment is reverted
+	deployment, err := clientset.AppsV1beta2().Deployments("oauth2-proxy").Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployment.Spec.Replicas = int32Ptr(5)
+	if _, err := clientset.AppsV1beta2().Deployments("oauth2-proxy").Update(deployment); err != nil {
+		t.Fatal(err)
+	}
+	watchers["deployments"].Modify(deployment)
+	waitFor(t, "Deployment reverted", func() bool {
+		return deploymentReplicas(clientset, name) == 1
+	})
+
+	// Deleted Service is recreated
+	service, err := clientset.CoreV1().Services("oauth2-proxy").Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchers["services"].Add(service)
+	if err := clientset.CoreV1().Services("oauth2-proxy").Delete(name, &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	watchers["services"].Delete(service)
+	waitFor(t, "Service recreated", func() bool {
+		_, err := clientset.CoreV1().Services("oauth2-proxy").Get(name, metav1.GetOptions{})
+		return err == nil
+	})
+
+	// Both Add and Delete of the Service may reconcile: wait until they're done
+	settled := 0
+	waitFor(t, "reconciles settled", func() bool {
+		n := len(clientset.Actions())
+		if n == settled {
+			return true
+		}
+		settled = n
+		time.Sleep(50 * time.Millisecond)
+		return false
+	})
+
+	// Objects unchanged by others are left as is: only the edit of test and its revert update the Deployment
+	updates := func() int {
+		n := 0
+		for _, action := range clientset.Actions() {
+			if action.GetVerb() == "update" && action.GetResource().Resource == "deployments" {
+				n++
+			}
+		}
+		return n
+	}
+	before := updates()
+	deployment, err = clientset.AppsV1beta2().Deployments("oauth2-proxy").Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchers["deployments"].Modify(deployment.DeepCopy())
+	deployment.Spec.Replicas = int32Ptr(7)
+	if _, err := clientset.AppsV1beta2().Deployments("oauth2-proxy").Update(deployment); err != nil {
+		t.Fatal(err)
+	}
+	watchers["deployments"].Modify(deployment)
+	waitFor(t, "Deployment reverted", func() bool {
+		return deploymentReplicas(clientset, name) == 1
+	})
+	if n := updates() - before; n != 2 {
+		t.Errorf("Deployment updated %d times, want 2", n)
+	}
+}
+
+func TestObserverOwner(t *testing.T) {
+	controller, clientset := newTestController(t, newTestConfig())
+	observer, err := NewObserver(clientset, controller, newTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := func(name string) string {
+		key, _ := observer.owner(&appsv1beta2.Deployment{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "oauth2-proxy"}})
+		return key
+	}
+
+	observer.apply("supersecret/supersecret", newTestIngress("supersecret", nil))
+	if key := owner("oauth2-proxy-github-example-corp-supersecret"); key != "Ingress supersecret/supersecret" {
+		t.Errorf("owner = %q, want Ingress supersecret/supersecret", key)
+	}
+
+	// Renamed app: previous oauth2_proxy isn't owned anymore
+	observer.apply("supersecret/supersecret", newTestIngress("supersecret", map[string]string{
+		"oauth2-proxy-manager.k8s.io/app-name": "topsecret",
+	}))
+	if key := owner("oauth2-proxy-github-example-corp-supersecret"); len(key) != 0 {
+		t.Errorf("renamed oauth2_proxy should have no owner, got %q", key)
+	}
+	if key := owner("oauth2-proxy-github-example-corp-topsecret"); key != "Ingress supersecret/supersecret" {
+		t.Errorf("owner = %q, want Ingress supersecret/supersecret", key)
+	}
+
+	observer.remove(newTestIngress("supersecret", map[string]string{
+		"oauth2-proxy-manager.k8s.io/app-name": "topsecret",
+	}))
+	if key := owner("oauth2-proxy-github-example-corp-topsecret"); len(key) != 0 {
+		t.Errorf("removed oauth2_proxy should have no owner, got %q", key)
+	}
+}
+
+func TestControllerDriftSharedProxy(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.Version = "v7.1.3"
+	cfg.Proxy["sharing"] = ProxySharingPerOrg
+	controller, clientset := newTestController(t, cfg)
+	settings := newTestSettings("supersecret")
+	controller.Apply(settings)
+
+	deployment, err := clientset.AppsV1beta2().Deployments("oauth2-proxy").Get("oauth2-proxy-github-example-corp", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff, err := controller.drift(settings, deployment); err != nil || len(diff) != 0 {
+		t.Errorf("shared oauth2_proxy should not be drifted, got %q (err=%v)", diff, err)
+	}
+	deployment.Spec.Replicas = int32Ptr(5)
+	if diff, err := controller.drift(settings, deployment); err != nil || len(diff) == 0 {
+		t.Errorf("edited shared oauth2_proxy should be drifted (err=%v)", err)
+	}
+
+	// Apps listed in ConfigMap of shared oauth2_proxy are not a drift
+	configMap, err := clientset.CoreV1().ConfigMaps("oauth2-proxy").Get("oauth2-proxy-github-example-corp", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff, err := controller.drift(settings, configMap); err != nil || len(diff) != 0 {
+		t.Errorf("ConfigMap of shared oauth2_proxy should not be drifted, got %q (err=%v)", diff, err)
+	}
+}
+
+func TestObserverUpdateClaim(t *testing.T) {
+	clientset, watcher, stop := startTestObserver(t)
+	defer close(stop)
+	exists := func(name string) bool {
+		_, err := clientset.AppsV1beta2().Deployments("oauth2-proxy").Get(name, metav1.GetOptions{})
+		return err == nil
+	}
+
+	watcher.Add(newTestIngress("supersecret", nil))
+	waitFor(t, "Deployment created", func() bool {
+		return exists("oauth2-proxy-github-example-corp-supersecret")
+	})
+
+	// app-name changed: old oauth2_proxy is replaced
+	watcher.Modify(newTestIngress("supersecret", map[string]string{
+		"oauth2-proxy-manager.k8s.io/app-name": "topsecret",
+	}))
+	waitFor(t, "Deployment renamed", func() bool {
+		return exists("oauth2-proxy-github-example-corp-topsecret") && !exists("oauth2-proxy-github-example-corp-supersecret")
+	})
+	want := map[string]string{"auth.example.com/github/topsecret": "oauth2-proxy-github-example-corp-topsecret"}
+	if paths := ingressPaths(t, clientset, defaultSharedIngressName); !reflect.DeepEqual(paths, want) {
+		t.Errorf("Ingress paths = %v, want %v", paths, want)
+	}
+
+	// Invalid annotations: current oauth2_proxy keeps running
+	watcher.Modify(newTestIngress("supersecret", map[string]string{
+		"oauth2-proxy-manager.k8s.io/app-name": "topsecret",
+		"oauth2-proxy-manager.k8s.io/replicas": "many",
+	}))
+	watcher.Add(newTestIngress("other", nil))
+	waitFor(t, "other Deployment created", func() bool {
+		return exists("oauth2-proxy-github-example-corp-other")
+	})
+	if !exists("oauth2-proxy-github-example-corp-topsecret") {
+		t.Error("oauth2_proxy should keep running with invalid annotations")
+	}
+
+	// Not claimed anymore: oauth2_proxy is removed
+	unclaimed := newTestIngress("supersecret", map[string]string{
+		"oauth2-proxy-manager.k8s.io/app-name": "topsecret",
+		"oauth2-proxy-manager.k8s.io/replicas": "many",
+	})
+	unclaimed.Annotations["kubernetes.io/ingress.class"] = "traefik"
+	watcher.Modify(unclaimed)
+	waitFor(t, "Deployment removed", func() bool {
+		return !exists("oauth2-proxy-github-example-corp-topsecret")
+	})
+}
+
+func TestObserverRename(t *testing.T) {
+	controller, clientset := newTestController(t, newTestConfig())
+	watcher := watch.NewFake()
+	clientset.PrependWatchReactor("ingresses", k8stesting.DefaultWatchReactor(watcher, nil))
+	exists := func(name string) bool {
+		_, err := clientset.AppsV1beta2().Deployments("oauth2-proxy").Get(name, metav1.GetOptions{})
+		return err == nil
+	}
+	applied := func() string {
+		ingress, err := clientset.ExtensionsV1beta1().Ingresses("newapp").Get("newapp", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ingress.Annotations["oauth2-proxy-manager.k8s.io/applied-app"]
+	}
+
+	// app-name changed while the manager was down
+	controller.Apply(newTestSettings("oldapp"))
+	ingress := newTestIngress("newapp", map[string]string{
+		"oauth2-proxy-manager.k8s.io/applied-app": "example-corp/oldapp",
+	})
+	if _, err := clientset.ExtensionsV1beta1().Ingresses("newapp").Create(ingress); err != nil {
+		t.Fatal(err)
+	}
+	observer, err := NewObserver(clientset, controller, newTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	observer.start(stop)
+	watcher.Add(ingress)
+	waitFor(t, "oldapp replaced by newapp", func() bool {
+		return exists("oauth2-proxy-github-example-corp-newapp") && !exists("oauth2-proxy-github-example-corp-oldapp") && applied() == "example-corp/newapp"
+	})
+
+	// github-org changed: same path is served by the new oauth2_proxy
+	ingress, err = clientset.ExtensionsV1beta1().Ingresses("newapp").Get("newapp", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingress.Annotations["oauth2-proxy-manager.k8s.io/github-org"] = "other-corp"
+	if _, err := clientset.ExtensionsV1beta1().Ingresses("newapp").Update(ingress); err != nil {
+		t.Fatal(err)
+	}
+	watcher.Modify(ingress)
+	waitFor(t, "example-corp replaced by other-corp", func() bool {
+		return exists("oauth2-proxy-github-other-corp-newapp") && !exists("oauth2-proxy-github-example-corp-newapp") && applied() == "other-corp/newapp"
+	})
+	want := map[string]string{"auth.example.com/github/newapp": "oauth2-proxy-github-other-corp-newapp"}
+	if paths := ingressPaths(t, clientset, defaultSharedIngressName); !reflect.DeepEqual(paths, want) {
+		t.Errorf("Ingress paths = %v, want %v", paths, want)
+	}
+}
+
+func TestObserverHTTPRoute(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.Gateway = "gateway-system/public"
+	controller, clientset := newTestController(t, cfg)
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	controller.Dynamic = dynamicClient
+	watcher := watch.NewFake()
+	dynamicClient.PrependWatchReactor("httproutes", k8stesting.DefaultWatchReactor(watcher, nil))
+	observer, err := NewObserver(clientset, controller, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	observer.start(stop)
+	name := "oauth2-proxy-github-example-corp-supersecret"
+
+	route := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "gateway.networking.k8s.io/v1",
+		"kind":       "HTTPRoute",
+		"metadata": map[string]interface{}{
+			"name":      "supersecret",
+			"namespace": "supersecret",
+			"annotations": map[string]interface{}{
+				"oauth2-proxy-manager.k8s.io/app-name":     "supersecret",
+				"oauth2-proxy-manager.k8s.io/github-org":   "example-corp",
+				"oauth2-proxy-manager.k8s.io/github-teams": "admin",
+			},
+		},
+	}}
+	watcher.Add(route)
+	waitFor(t, "Deployment created", func() bool {
+		return deploymentReplicas(clientset, name) == 1
+	})
+	if _, err := dynamicClient.Resource(httpRouteResource).Namespace("oauth2-proxy").Get(name, metav1.GetOptions{}); err != nil {
+		t.Errorf("HTTPRoute of oauth2_proxy should be created, got err=%v", err)
+	}
+
+	watcher.Delete(route)
+	waitFor(t, "Deployment deleted", func() bool {
+		_, err := clientset.AppsV1beta2().Deployments("oauth2-proxy").Get(name, metav1.GetOptions{})
+		return apierrors.IsNotFound(err)
+	})
+	if _, err := dynamicClient.Resource(httpRouteResource).Namespace("oauth2-proxy").Get(name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("HTTPRoute of oauth2_proxy should be deleted, got err=%v", err)
+	}
+}
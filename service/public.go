@@ -0,0 +1,178 @@
+package service
+
+import (
+	"strings"
+
+	"k8s.io/api/extensions/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/Laica-Lunasys/oauth2-proxy-manager/models"
+	"github.com/sirupsen/logrus"
+)
+
+// publicIngressName - Sibling Ingress serving public paths of the Ingress ("supersecret" => "supersecret-public")
+func publicIngressName(source *v1beta1.Ingress) string {
+	return source.Name + "-public"
+}
+
+// newPublicIngress - Ingress serving public paths of source without authentication.
+// Auth annotations apply to the whole Ingress, and nginx auth subrequests don't carry the original path (so skip_auth_regex can't be used):
+// public paths need an Ingress of their own. Each path is routed to the backend serving it in source.
+// Paths match exactly where the controller supports it ("/healthz" doesn't expose "/healthz-admin"), as prefixes otherwise.
+func (c *Controller) newPublicIngress(source *v1beta1.Ingress, settings *models.ServiceSettings) *v1beta1.Ingress {
+	adapter := appIngressAdapter(settings)
+	annotations := map[string]string{}
+	for key, value := range source.Annotations {
+		// Keep ingress.class and controller behavior (e.g. ssl-redirect), except authentication
+		if key == "kubernetes.io/ingress.class" || adapter.keepAnnotation(key) {
+			annotations[key] = value
+		}
+	}
+
+	rules := []v1beta1.IngressRule{}
+	for _, rule := range source.Spec.Rules {
+		publicPaths := []v1beta1.HTTPIngressPath{}
+		for _, path := range settings.PublicPaths {
+			backend := servingBackend(source, rule, path)
+			if backend == nil {
+				continue
+			}
+			exact, exactAnnotations, _ := adapter.exactPath(path)
+			for _, annotation := range exactAnnotations {
+				annotations[annotation[0]] = annotation[1]
+			}
+			publicPaths = append(publicPaths, v1beta1.HTTPIngressPath{Path: exact, Backend: *backend})
+		}
+		if len(publicPaths) == 0 {
+			continue
+		}
+		rules = append(rules, v1beta1.IngressRule{
+			Host: rule.Host,
+			IngressRuleValue: v1beta1.IngressRuleValue{
+				HTTP: &v1beta1.HTTPIngressRuleValue{Paths: publicPaths},
+			},
+		})
+	}
+
+	return &v1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        publicIngressName(source),
+			Namespace:   source.Namespace,
+			Labels:      c.Instance.labels(),
+			Annotations: annotations,
+			// Removed together with source
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "extensions/v1beta1",
+				Kind:       "Ingress",
+				Name:       source.Name,
+				UID:        source.UID,
+			}},
+		},
+		Spec: v1beta1.IngressSpec{
+			TLS:   source.Spec.TLS,
+			Rules: rules,
+		},
+	}
+}
+
+// servingBackend - Backend of rule serving path: the longest matching prefix (as nginx locations), or default backend of the Ingress
+func servingBackend(source *v1beta1.Ingress, rule v1beta1.IngressRule, path string) *v1beta1.IngressBackend {
+	var backend *v1beta1.IngressBackend
+	longest := -1
+	if rule.HTTP != nil {
+		for i, rulePath := range rule.HTTP.Paths {
+			if len(rulePath.Path) > longest && strings.HasPrefix(path, rulePath.Path) {
+				backend = &rule.HTTP.Paths[i].Backend
+				longest = len(rulePath.Path)
+			}
+		}
+	}
+	if backend == nil {
+		backend = source.Spec.Backend
+	}
+	return backend
+}
+
+// ApplyPublicIngress - Create or update Ingress of public paths of source. Without public paths, it's deleted.
+func (c *Controller) ApplyPublicIngress(source *v1beta1.Ingress, settings *models.ServiceSettings) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.applyPublicIngress(source, settings)
+}
+
+func (c *Controller) applyPublicIngress(source *v1beta1.Ingress, settings *models.ServiceSettings) {
+	if len(settings.PublicPaths) == 0 {
+		c.deletePublicIngress(source)
+		return
+	}
+
+	ingressClient := c.Clientset.ExtensionsV1beta1().Ingresses(source.Namespace)
+	ingress := c.newPublicIngress(source, settings)
+
+	logrus.Printf("[oauth2_proxy] Check public Ingress...")
+	result, err := ingressClient.Get(ingress.Name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		logrus.Panic(err)
+	}
+	if apierrors.IsNotFound(err) {
+		if c.dryRun("Ingress", nil, ingress) {
+			return
+		}
+		logrus.Printf("[oauth2_proxy] Creating public Ingress...")
+		result, err = ingressClient.Create(ingress)
+		if err != nil {
+			logrus.Panic(err)
+		}
+		logrus.Printf("[oauth2_proxy] Created public Ingress! %q", result.GetObjectMeta().GetName())
+	} else {
+		if !c.ownsPublicIngress(result, source) {
+			logrus.Errorf("[oauth2_proxy] Ingress %s/%s is not generated for public paths, not overwritten", result.Namespace, result.Name)
+			return
+		}
+		if c.dryRun("Ingress", result, ingress) {
+			return
+		}
+		logrus.Printf("[oauth2_proxy] Update public Ingress...")
+		ingress.SetResourceVersion(result.GetResourceVersion())
+		result, err = ingressClient.Update(ingress)
+		if err != nil {
+			logrus.Panic(err)
+		}
+		logrus.Printf("[oauth2_proxy] Updated public Ingress! %q", result.GetObjectMeta().GetName())
+	}
+}
+
+// DeletePublicIngress - Delete Ingress of public paths of source, if any
+func (c *Controller) DeletePublicIngress(source *v1beta1.Ingress) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deletePublicIngress(source)
+}
+
+func (c *Controller) deletePublicIngress(source *v1beta1.Ingress) {
+	ingressClient := c.Clientset.ExtensionsV1beta1().Ingresses(source.Namespace)
+	result, err := ingressClient.Get(publicIngressName(source), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return
+	} else if err != nil {
+		logrus.Panic(err)
+	}
+	// Ingress of the same name made by user is kept
+	if c.ownsPublicIngress(result, source) {
+		c.deleteObject("Ingress", source.Namespace, result.Name, ingressClient.Delete)
+	}
+}
+
+// ownsPublicIngress - Whether ingress is the public Ingress of source generated by this instance
+func (c *Controller) ownsPublicIngress(ingress *v1beta1.Ingress, source *v1beta1.Ingress) bool {
+	if ingress.Labels[instanceLabel] != c.Instance.labels()[instanceLabel] {
+		return false
+	}
+	for _, owner := range ingress.OwnerReferences {
+		if owner.Kind == "Ingress" && owner.Name == source.Name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package service
+
+import (
+	"os"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ConfigWatcher - Reload configuration when ConfigMap / Secret of the manager changes
+type ConfigWatcher struct {
+	Clientset     kubernetes.Interface
+	Controller    *Controller
+	Args          []string
+	Namespace     string
+	ConfigMapName string
+	SecretName    string
+
+	// OnReload - Called after global settings changed (e.g. Observer.Resync)
+	OnReload func()
+
+	mu        sync.Mutex
+	configMap map[string]string
+	secret    map[string]string
+	seen      map[string]bool
+}
+
+func NewConfigWatcher(clientset kubernetes.Interface, controller *Controller, cfg *Config, args []string) *ConfigWatcher {
+	return &ConfigWatcher{
+		Clientset:     clientset,
+		Controller:    controller,
+		Args:          args,
+		Namespace:     cfg.Namespace,
+		ConfigMapName: cfg.ConfigMapName,
+		SecretName:    cfg.SecretName,
+		seen:          map[string]bool{},
+	}
+}
+
+func (w *ConfigWatcher) Run(stop <-chan struct{}) {
+	logrus.Infof("[ConfigWatcher] Watching ConfigMap %s/%s and Secret %s/%s...", w.Namespace, w.ConfigMapName, w.Namespace, w.SecretName)
+
+	configMapWatcher := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", w.ConfigMapName).String()
+			return w.Clientset.CoreV1().ConfigMaps(w.Namespace).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", w.ConfigMapName).String()
+			return w.Clientset.CoreV1().ConfigMaps(w.Namespace).Watch(options)
+		},
+	}
+	_, configMapInformer := cache.NewInformer(configMapWatcher, &v1.ConfigMap{}, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			w.update(&w.configMap, obj.(*v1.ConfigMap).Data)
+		},
+		UpdateFunc: func(old interface{}, new interface{}) {
+			w.update(&w.configMap, new.(*v1.ConfigMap).Data)
+		},
+		DeleteFunc: func(obj interface{}) {
+			w.update(&w.configMap, nil)
+		},
+	})
+
+	secretWatcher := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", w.SecretName).String()
+			return w.Clientset.CoreV1().Secrets(w.Namespace).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", w.SecretName).String()
+			return w.Clientset.CoreV1().Secrets(w.Namespace).Watch(options)
+		},
+	}
+	_, secretInformer := cache.NewInformer(secretWatcher, &v1.Secret{}, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			w.update(&w.secret, secretData(obj.(*v1.Secret)))
+		},
+		UpdateFunc: func(old interface{}, new interface{}) {
+			w.update(&w.secret, secretData(new.(*v1.Secret)))
+		},
+		DeleteFunc: func(obj interface{}) {
+			w.update(&w.secret, nil)
+		},
+	})
+
+	go configMapInformer.Run(stop)
+	go secretInformer.Run(stop)
+	<-stop
+}
+
+func secretData(secret *v1.Secret) map[string]string {
+	data := map[string]string{}
+	for key, value := range secret.Data {
+		data[key] = string(value)
+	}
+	return data
+}
+
+// update - Replace data of ConfigMap or Secret, then reload
+func (w *ConfigWatcher) update(target *map[string]string, data map[string]string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	*target = data
+	for key := range data {
+		w.seen[key] = true
+	}
+	w.reload()
+}
+
+// lookupEnv - ConfigMap / Secret first, then environment variables.
+// Environment variables are loaded from ConfigMap / Secret at startup (envFrom),
+// so keys once seen in them are not looked up anymore: removing the key unsets it.
+func (w *ConfigWatcher) lookupEnv(key string) (string, bool) {
+	if value, ok := w.secret[key]; ok {
+		return value, true
+	}
+	if value, ok := w.configMap[key]; ok {
+		return value, true
+	}
+	if w.seen[key] {
+		return "", false
+	}
+	return os.LookupEnv(key)
+}
+
+func (w *ConfigWatcher) reload() {
+	cfg, err := LoadConfig(w.Args, w.lookupEnv)
+	if err != nil {
+		logrus.Errorf("[ConfigWatcher] Failed to load configuration, keep current one: %s", err)
+		return
+	}
+	changed, err := w.Controller.Reload(cfg)
+	if err != nil {
+		logrus.Errorf("[ConfigWatcher] Failed to reload configuration, keep current one: %s", err)
+		return
+	}
+	if !changed {
+		return
+	}
+
+	logrus.Info("[ConfigWatcher] Configuration changed. Reconciling all apps...")
+	if w.OnReload != nil {
+		w.OnReload()
+	}
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"os"
+	"testing"
+)
+
+func newTestConfigWatcher(t *testing.T) *ConfigWatcher {
+	controller, clientset := newTestController(t, newTestConfig())
+	// Required settings by flags, the rest from ConfigMap / Secret
+	args := []string{"--domain=auth.example.com", "--cookie-salt=salt", "--client-id=client-id", "--client-secret=client-secret"}
+	return NewConfigWatcher(clientset, controller, newTestConfig(), args)
+}
+
+func TestConfigWatcherLookupEnv(t *testing.T) {
+	os.Setenv("WHITELIST_DOMAIN", ".example.com")
+	os.Setenv("COOKIE_DOMAIN", ".example.com")
+	defer os.Unsetenv("WHITELIST_DOMAIN")
+	defer os.Unsetenv("COOKIE_DOMAIN")
+	watcher := newTestConfigWatcher(t)
+
+	// Secret wins over ConfigMap, which wins over environment variables
+	watcher.update(&watcher.configMap, map[string]string{"WHITELIST_DOMAIN": ".example.org", "INGRESS_MODE": IngressModePerApp})
+	watcher.update(&watcher.secret, map[string]string{"INGRESS_MODE": IngressModeShared})
+	if value, ok := watcher.lookupEnv("WHITELIST_DOMAIN"); !ok || value != ".example.org" {
+		t.Errorf("WHITELIST_DOMAIN = %q, %v, want .example.org of ConfigMap", value, ok)
+	}
+	if value, _ := watcher.lookupEnv("INGRESS_MODE"); value != IngressModeShared {
+		t.Errorf("INGRESS_MODE = %q, want %s of Secret", value, IngressModeShared)
+	}
+
+	// Removed from ConfigMap: unset, though the environment variable loaded at startup still has it
+	watcher.update(&watcher.configMap, map[string]string{})
+	if value, ok := watcher.lookupEnv("WHITELIST_DOMAIN"); ok {
+		t.Errorf("removed WHITELIST_DOMAIN should be unset, got %q", value)
+	}
+	// Never in ConfigMap / Secret: environment variable
+	if value, ok := watcher.lookupEnv("COOKIE_DOMAIN"); !ok || value != ".example.com" {
+		t.Errorf("COOKIE_DOMAIN = %q, %v, want environment variable", value, ok)
+	}
+}
+
+func TestConfigWatcherReload(t *testing.T) {
+	watcher := newTestConfigWatcher(t)
+	reloaded := 0
+	watcher.OnReload = func() { reloaded++ }
+
+	watcher.update(&watcher.configMap, map[string]string{"COOKIE_DOMAIN": ".example.org"})
+	if watcher.Controller.Env.CookieDomain != ".example.org" || reloaded != 1 {
+		t.Errorf("cookie domain = %q after %d reloads, want .example.org after 1", watcher.Controller.Env.CookieDomain, reloaded)
+	}
+
+	// Nothing changed
+	watcher.update(&watcher.configMap, map[string]string{"COOKIE_DOMAIN": ".example.org"})
+	if reloaded != 1 {
+		t.Errorf("reloaded %d times without change, want 1", reloaded)
+	}
+
+	// Invalid configuration keeps current one
+	watcher.update(&watcher.configMap, map[string]string{"COOKIE_DOMAIN": ".example.net", "OAUTH2_PROXY_VERSION": "v99.0.0"})
+	if watcher.Controller.Env.CookieDomain != ".example.org" || reloaded != 1 {
+		t.Errorf("invalid configuration should be ignored, got cookie domain %q after %d reloads", watcher.Controller.Env.CookieDomain, reloaded)
+	}
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	"github.com/Laica-Lunasys/oauth2-proxy-manager/models"
+)
+
+// Render - Objects generated for the app, without calling API.
+// In shared Ingress mode, the Ingress has only the route of this app. With Gateway, HTTPRoute replaces the Ingress.
+// Apps shared per org render oauth2_proxy of the org, as applied by Apply.
+func (c *Controller) Render(settings *models.ServiceSettings) ([]runtime.Object, error) {
+	spec, err := c.resolve(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := c.servingProxy(settings)
+	objects := []runtime.Object{}
+	if spec.SessionStore.RedisSecretName == c.managedRedisName() {
+		service, secret, deployment := c.newManagedRedis()
+		objects = append(objects, service, secret, deployment)
+	}
+	objects = append(objects,
+		c.newService(proxy),
+		c.newSecret("oauth2-proxy", proxy, spec),
+		c.newConfigMap("oauth2-proxy", proxy),
+		c.newDeployment(proxy, spec),
+	)
+	if pdb := c.newPodDisruptionBudget(proxy, spec.Deployment); pdb != nil {
+		objects = append(objects, pdb)
+	}
+	if hpa := c.newHorizontalPodAutoscaler(proxy, spec.Deployment); hpa != nil {
+		objects = append(objects, hpa)
+	}
+
+	if c.gatewayEnabled() {
+		return append(objects, c.newHTTPRoute(proxy)), nil
+	}
+	controller := appIngressAdapter(proxy).Name()
+	ingressName := c.sharedIngressName(controller)
+	if c.Ingress.Mode == IngressModePerApp {
+		ingressName = proxyName(proxy)
+	}
+	objects = append(objects, c.newIngress(ingressName, controller, []ingressRoute{c.ingressRoute(proxy)}))
+	return objects, nil
+}
+
+// RenderManifests - YAML of objects generated for each Ingress in data (multi-document YAML).
+// Values of Secrets are redacted. Ingresses failed to render are reported together.
+func (c *Controller) RenderManifests(data []byte) ([]byte, error) {
+	out := &bytes.Buffer{}
+	errs := []string{}
+
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(data)))
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+
+		ingress := &v1beta1.Ingress{}
+		if err := yaml.Unmarshal(doc, ingress); err != nil {
+			return nil, err
+		}
+		if ingress.Kind != "Ingress" {
+			continue
+		}
+		key := fmt.Sprintf("%s/%s", ingress.Namespace, ingress.Name)
+
+		settings, err := parseAnnotations(ingress.ObjectMeta, c.Instance)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("Ingress %s: %s", key, err))
+			continue
+		}
+		objects, err := c.Render(settings)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("Ingress %s: %s", key, err))
+			continue
+		}
+		if len(settings.PublicPaths) != 0 {
+			objects = append(objects, c.newPublicIngress(ingress, settings))
+		}
+		for _, obj := range objects {
+			manifest, err := renderObject(obj)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(out, "---\n# Ingress %s\n", key)
+			out.Write(manifest)
+		}
+	}
+
+	if len(errs) != 0 {
+		return out.Bytes(), errors.New(strings.Join(errs, "\n"))
+	}
+	return out.Bytes(), nil
+}
+
+// renderObject - YAML with apiVersion / kind
+func renderObject(obj runtime.Object) ([]byte, error) {
+	obj = obj.DeepCopyObject()
+	kinds, _, err := scheme.Scheme.ObjectKinds(obj)
+	if err != nil {
+		return nil, err
+	}
+	obj.GetObjectKind().SetGroupVersionKind(kinds[0])
+
+	if secret, ok := obj.(*apiv1.Secret); ok {
+		for key := range secret.StringData {
+			secret.StringData[key] = "<redacted>"
+		}
+		for key := range secret.Data {
+			secret.Data[key] = []byte("<redacted>")
+		}
+	}
+	return yaml.Marshal(obj)
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata/render")
+
+// TestRenderManifests - Compare rendered manifests of testdata/render/<input> with <name>.golden.yaml.
+// Run `go test ./service -run TestRenderManifests -update` after intended changes.
+func TestRenderManifests(t *testing.T) {
+	cases := []struct {
+		name   string
+		input  string
+		config func(cfg *Config)
+	}{
+		{name: "basic", input: "basic.yaml"},
+		{name: "tuning", input: "tuning.yaml"},
+		{name: "auth-host", input: "auth-host.yaml"},
+		{name: "redis", input: "redis.yaml", config: func(cfg *Config) {
+			cfg.Proxy["managed-redis"] = "true"
+		}},
+		{name: "multi", input: "multi.yaml"},
+		{name: "public-paths", input: "public-paths.yaml"},
+		{name: "invalid", input: "invalid.yaml"},
+		{name: "per-app-cert-manager", input: "basic.yaml", config: func(cfg *Config) {
+			cfg.IngressMode = IngressModePerApp
+			cfg.ClusterIssuer = "letsencrypt"
+		}},
+		{name: "per-org", input: "basic.yaml", config: func(cfg *Config) {
+			cfg.Version = "v7.1.3"
+			cfg.Proxy["sharing"] = ProxySharingPerOrg
+		}},
+		{name: "tls-hosts", input: "basic.yaml", config: func(cfg *Config) {
+			cfg.TLSHosts = "auth.example.com"
+			cfg.TLSSecretName = "auth.example.com-tls"
+			cfg.IngressClass = "nginx-internal"
+			cfg.Proxy["replicas"] = "2"
+			cfg.Proxy["cpu-request"] = "20m"
+		}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := newTestConfig()
+			if tc.config != nil {
+				tc.config(cfg)
+			}
+			controller, err := NewController(nil, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			input, err := ioutil.ReadFile(filepath.Join("testdata", "render", tc.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			output, err := controller.RenderManifests(input)
+			if err != nil {
+				// Errors are part of the golden file
+				output = append(output, []byte("# error:\n# "+strings.Replace(err.Error(), "\n", "\n# ", -1)+"\n")...)
+			}
+
+			golden := filepath.Join("testdata", "render", tc.name+".golden.yaml")
+			if *update {
+				if err := ioutil.WriteFile(golden, output, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(output) != string(want) {
+				t.Errorf("rendered manifests differ from %s:\n%s", golden, output)
+			}
+		})
+	}
+}
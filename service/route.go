@@ -0,0 +1,154 @@
+package service
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/Laica-Lunasys/oauth2-proxy-manager/models"
+	"github.com/sirupsen/logrus"
+)
+
+// routeWatcher - HTTPRoutes in namespace, selected by IngressSelector as Ingresses
+func (ob *Observer) routeWatcher(namespace string) *cache.ListWatch {
+	selector := ob.IngressSelector.String()
+	client := ob.Controller.Dynamic.Resource(httpRouteResource).Namespace(namespace)
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = selector
+			return client.List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = selector
+			return client.Watch(options)
+		},
+	}
+}
+
+func (ob *Observer) routeHandler() cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			key, err := cache.MetaNamespaceKeyFunc(obj)
+			if err == nil {
+				route := obj.(*unstructured.Unstructured)
+				if !ob.namespaceSelected(route.GetNamespace()) {
+					return
+				}
+				logrus.Infof("[Informer] Added HTTPRoute %s", key)
+				ob.applyRoute(key, route, nil)
+			}
+		},
+		UpdateFunc: func(old interface{}, new interface{}) {
+			key, err := cache.MetaNamespaceKeyFunc(new)
+			if err == nil {
+				route := new.(*unstructured.Unstructured)
+				if !ob.namespaceSelected(route.GetNamespace()) {
+					return
+				}
+				if old.(*unstructured.Unstructured).GetResourceVersion() == route.GetResourceVersion() {
+					logrus.Debugf("[Informer] Resync HTTPRoute %s", key)
+				} else {
+					logrus.Infof("[Informer] Update HTTPRoute %s", key)
+				}
+				previous, _ := parseRouteIdentity(routeMeta(old.(*unstructured.Unstructured)), ob.Controller.Instance)
+				ob.applyRoute(key, route, previous)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			if err == nil {
+				if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+				route, ok := obj.(*unstructured.Unstructured)
+				if !ok || !ob.namespaceSelected(route.GetNamespace()) {
+					return
+				}
+				logrus.Infof("[Informer] Delete HTTPRoute: %s", key)
+				ob.removeRoute(route)
+			}
+		},
+	}
+}
+
+// routes - Observed HTTPRoutes in namespace (all namespaces if empty)
+func (ob *Observer) routes(namespace string) []*unstructured.Unstructured {
+	routes := []*unstructured.Unstructured{}
+	for _, store := range ob.routeStores {
+		for _, obj := range store.List() {
+			route, ok := obj.(*unstructured.Unstructured)
+			if ok && (len(namespace) == 0 || route.GetNamespace() == namespace) {
+				routes = append(routes, route)
+			}
+		}
+	}
+	return routes
+}
+
+// applyRoute - Apply the app of the HTTPRoute, as reconcile of Ingress.
+// The applied app is not recorded in HTTPRoutes: only renames seen while running remove the previous app.
+func (ob *Observer) applyRoute(key string, route *unstructured.Unstructured, previous *models.ServiceSettings) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	settings, err := parseRouteAnnotations(routeMeta(route), ob.Controller.Instance)
+	if err != nil {
+		logAnnotationError("HTTPRoute", key, err)
+		if _, invalid := err.(AnnotationError); previous != nil && !invalid {
+			logrus.Infof("[Observer] HTTPRoute %s is not protected anymore (%s), removing oauth2_proxy(%s)", key, err, previous.AppName)
+			ob.Controller.Delete(previous)
+			ob.unindex("HTTPRoute " + key)
+		}
+		return
+	}
+
+	if err := ob.Controller.Apply(settings); err != nil {
+		return
+	}
+	if previous != nil && proxyName(previous) != proxyName(settings) {
+		logrus.Infof("[Observer] HTTPRoute %s is moved from %s to %s", key, proxyName(previous), proxyName(settings))
+		ob.Controller.Delete(previous)
+	}
+	ob.index("HTTPRoute "+key, settings)
+}
+
+// removeRoute - Remove oauth2_proxy of the HTTPRoute, even if its annotations are invalid now
+func (ob *Observer) removeRoute(route *unstructured.Unstructured) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	ob.unindex("HTTPRoute " + route.GetNamespace() + "/" + route.GetName())
+	settings, err := parseRouteIdentity(routeMeta(route), ob.Controller.Instance)
+	if err != nil {
+		return
+	}
+	ob.Controller.Delete(settings)
+}
+
+// routeMeta - Metadata of HTTPRoute read by annotation parsers
+func routeMeta(route *unstructured.Unstructured) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:        route.GetName(),
+		Namespace:   route.GetNamespace(),
+		Annotations: route.GetAnnotations(),
+	}
+}
+
+// parseRouteIdentity - App claimed by the HTTPRoute, enough to remove its oauth2_proxy
+func parseRouteIdentity(meta metav1.ObjectMeta, instance InstanceOption) (*models.ServiceSettings, error) {
+	lookup := annotationLookup(meta.Annotations, instance.AnnotationPrefix)
+	if err := checkAppClaimed(lookup); err != nil {
+		return nil, err
+	}
+	return parseAppIdentity(instance, lookup)
+}
+
+// parseRouteAnnotations - Settings of the app protected by HTTPRoute.
+// Unlike Ingress, there's no ingress.class / auth-url to check: authentication of routes is configured in the Gateway implementation.
+func parseRouteAnnotations(meta metav1.ObjectMeta, instance InstanceOption) (*models.ServiceSettings, error) {
+	lookup := annotationLookup(meta.Annotations, instance.AnnotationPrefix)
+	if err := checkAppClaimed(lookup); err != nil {
+		return nil, err
+	}
+	return parseAppSettings(instance, lookup)
+}
@@ -0,0 +1,171 @@
+package service
+
+import (
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"github.com/Laica-Lunasys/oauth2-proxy-manager/models"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultHPAMaxReplicas = 3
+	defaultHPATargetCPU   = 80
+)
+
+// newPodDisruptionBudget - PodDisruptionBudget of the app, nil if disabled
+func (c *Controller) newPodDisruptionBudget(settings *models.ServiceSettings, tuning models.DeploymentSettings) *policyv1beta1.PodDisruptionBudget {
+	if !disruptionEnabled(tuning) {
+		return nil
+	}
+	name := proxyName(settings)
+	pdb := &policyv1beta1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "oauth2-proxy",
+			Labels:    c.Instance.labels(),
+		},
+		Spec: policyv1beta1.PodDisruptionBudgetSpec{
+			MinAvailable:   tuning.Disruption.MinAvailable,
+			MaxUnavailable: tuning.Disruption.MaxUnavailable,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app": name,
+				},
+			},
+		},
+	}
+	if pdb.Spec.MinAvailable == nil && pdb.Spec.MaxUnavailable == nil {
+		maxUnavailable := intstr.FromInt(1)
+		pdb.Spec.MaxUnavailable = &maxUnavailable
+	}
+	return pdb
+}
+
+func (c *Controller) applyPodDisruptionBudget(settings *models.ServiceSettings, tuning models.DeploymentSettings) {
+	pdbClient := c.Clientset.PolicyV1beta1().PodDisruptionBudgets("oauth2-proxy")
+	name := proxyName(settings)
+
+	pdb := c.newPodDisruptionBudget(settings, tuning)
+	if pdb == nil {
+		c.deleteObject("PodDisruptionBudget", "oauth2-proxy", name, pdbClient.Delete)
+		return
+	}
+
+	logrus.Printf("[oauth2_proxy] Check PodDisruptionBudget...")
+	result, err := pdbClient.Get(name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		logrus.Panic(err)
+	}
+	if apierrors.IsNotFound(err) {
+		if c.dryRun("PodDisruptionBudget", nil, pdb) {
+			return
+		}
+		logrus.Printf("[oauth2_proxy] Creating PodDisruptionBudget...")
+		result, err = pdbClient.Create(pdb)
+		if err != nil {
+			logrus.Panic(err)
+		}
+		logrus.Printf("[oauth2_proxy] Created PodDisruptionBudget! %q", result.GetObjectMeta().GetName())
+	} else {
+		if c.dryRun("PodDisruptionBudget", result, pdb) {
+			return
+		}
+		logrus.Printf("[oauth2_proxy] Update PodDisruptionBudget...")
+		pdb.SetResourceVersion(result.GetResourceVersion())
+		result, err = pdbClient.Update(pdb)
+		if err != nil {
+			logrus.Panic(err)
+		}
+		logrus.Printf("[oauth2_proxy] Updated PodDisruptionBudget! %q", result.GetObjectMeta().GetName())
+	}
+}
+
+// newHorizontalPodAutoscaler - HorizontalPodAutoscaler of the app, nil if disabled
+func (c *Controller) newHorizontalPodAutoscaler(settings *models.ServiceSettings, tuning models.DeploymentSettings) *autoscalingv1.HorizontalPodAutoscaler {
+	if !autoscalingEnabled(tuning) {
+		return nil
+	}
+	name := proxyName(settings)
+	hpa := &autoscalingv1.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "oauth2-proxy",
+			Labels:    c.Instance.labels(),
+		},
+		Spec: autoscalingv1.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv1.CrossVersionObjectReference{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Name:       name,
+			},
+			MinReplicas:                    tuning.Autoscaling.MinReplicas,
+			MaxReplicas:                    defaultHPAMaxReplicas,
+			TargetCPUUtilizationPercentage: tuning.Autoscaling.TargetCPUUtilization,
+		},
+	}
+	if hpa.Spec.MinReplicas == nil && tuning.Replicas != nil && *tuning.Replicas > 0 {
+		// minReplicas: 0 is refused by API server
+		hpa.Spec.MinReplicas = tuning.Replicas
+	}
+	if tuning.Autoscaling.MaxReplicas != nil {
+		hpa.Spec.MaxReplicas = *tuning.Autoscaling.MaxReplicas
+	}
+	if hpa.Spec.MinReplicas != nil && *hpa.Spec.MinReplicas > hpa.Spec.MaxReplicas {
+		hpa.Spec.MaxReplicas = *hpa.Spec.MinReplicas
+	}
+	if hpa.Spec.TargetCPUUtilizationPercentage == nil {
+		hpa.Spec.TargetCPUUtilizationPercentage = int32Ptr(defaultHPATargetCPU)
+	}
+	return hpa
+}
+
+func (c *Controller) applyHorizontalPodAutoscaler(settings *models.ServiceSettings, tuning models.DeploymentSettings) {
+	hpaClient := c.Clientset.AutoscalingV1().HorizontalPodAutoscalers("oauth2-proxy")
+	name := proxyName(settings)
+
+	hpa := c.newHorizontalPodAutoscaler(settings, tuning)
+	if hpa == nil {
+		c.deleteObject("HorizontalPodAutoscaler", "oauth2-proxy", name, hpaClient.Delete)
+		return
+	}
+
+	logrus.Printf("[oauth2_proxy] Check HorizontalPodAutoscaler...")
+	result, err := hpaClient.Get(name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		logrus.Panic(err)
+	}
+	if apierrors.IsNotFound(err) {
+		if c.dryRun("HorizontalPodAutoscaler", nil, hpa) {
+			return
+		}
+		logrus.Printf("[oauth2_proxy] Creating HorizontalPodAutoscaler...")
+		result, err = hpaClient.Create(hpa)
+		if err != nil {
+			logrus.Panic(err)
+		}
+		logrus.Printf("[oauth2_proxy] Created HorizontalPodAutoscaler! %q", result.GetObjectMeta().GetName())
+	} else {
+		if c.dryRun("HorizontalPodAutoscaler", result, hpa) {
+			return
+		}
+		logrus.Printf("[oauth2_proxy] Update HorizontalPodAutoscaler...")
+		hpa.SetResourceVersion(result.GetResourceVersion())
+		result, err = hpaClient.Update(hpa)
+		if err != nil {
+			logrus.Panic(err)
+		}
+		logrus.Printf("[oauth2_proxy] Updated HorizontalPodAutoscaler! %q", result.GetObjectMeta().GetName())
+	}
+}
+
+func disruptionEnabled(tuning models.DeploymentSettings) bool {
+	return tuning.Disruption.Enabled != nil && *tuning.Disruption.Enabled
+}
+
+func autoscalingEnabled(tuning models.DeploymentSettings) bool {
+	return tuning.Autoscaling.Enabled != nil && *tuning.Autoscaling.Enabled
+}
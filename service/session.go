@@ -0,0 +1,343 @@
+package service
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	appsv1beta2 "k8s.io/api/apps/v1beta2"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"github.com/Laica-Lunasys/oauth2-proxy-manager/models"
+	"github.com/sirupsen/logrus"
+)
+
+// Session stores of oauth2_proxy
+const (
+	SessionStoreCookie = "cookie"
+	SessionStoreRedis  = "redis"
+)
+
+const (
+	// DefaultRedisSecretKey - Key of redis connection URL in the Secret
+	DefaultRedisSecretKey = "redis-connection-url"
+	// DefaultRedisImage - Image of managed Redis
+	DefaultRedisImage = "redis:5-alpine"
+	// defaultManagedRedisName - Name of managed Redis Deployment / Service / Secret, for default instance
+	defaultManagedRedisName = "oauth2-proxy-redis"
+	// managedRedisPasswordKey - Key of requirepass of managed Redis in its Secret
+	managedRedisPasswordKey = "redis-password"
+	// managedRedisRunAsUser - UID of redis user of the official image
+	managedRedisRunAsUser = 999
+)
+
+// managedRedisName - Name of managed Redis of this instance
+func (c *Controller) managedRedisName() string {
+	return c.Instance.objectName(defaultManagedRedisName)
+}
+
+// parseSessionStoreSettings - Parse session store from annotations or environment variables.
+func parseSessionStoreSettings(lookup lookupFunc) (models.SessionStoreSettings, error) {
+	settings := models.SessionStoreSettings{}
+	if value, ok := lookup("session-store"); ok {
+		value = strings.ToLower(value)
+		if value != SessionStoreCookie && value != SessionStoreRedis {
+			return settings, fmt.Errorf("session-store %q is invalid: must be cookie or redis", value)
+		}
+		settings.Type = value
+	}
+	if value, ok := lookup("redis-secret-name"); ok {
+		settings.RedisSecretName = value
+	}
+	if value, ok := lookup("redis-secret-key"); ok {
+		settings.RedisSecretKey = value
+	}
+	return settings, nil
+}
+
+// resolveSessionStore - Merge per-app session store with global defaults.
+func (c *Controller) resolveSessionStore(settings *models.ServiceSettings, release proxyRelease) (models.SessionStoreSettings, error) {
+	session := c.Proxy.SessionStore
+	if len(settings.SessionStore.Type) != 0 {
+		session.Type = settings.SessionStore.Type
+	}
+	if len(settings.SessionStore.RedisSecretName) != 0 {
+		session.RedisSecretName = settings.SessionStore.RedisSecretName
+	}
+	if len(settings.SessionStore.RedisSecretKey) != 0 {
+		session.RedisSecretKey = settings.SessionStore.RedisSecretKey
+	}
+	if len(session.Type) == 0 {
+		session.Type = SessionStoreCookie
+	}
+	if session.Type != SessionStoreRedis {
+		return session, nil
+	}
+
+	if !release.SessionStore {
+		return session, fmt.Errorf("redis session store requires oauth2_proxy v4 or later")
+	}
+	if len(session.RedisSecretName) == 0 {
+		if !c.Proxy.ManagedRedis {
+			return session, fmt.Errorf("redis session store requires redis-secret-name (or managed redis)")
+		}
+		session.RedisSecretName = c.managedRedisName()
+		session.RedisSecretKey = DefaultRedisSecretKey
+	}
+	if len(session.RedisSecretKey) == 0 {
+		session.RedisSecretKey = DefaultRedisSecretKey
+	}
+	return session, nil
+}
+
+// sessionStoreArgs - Flags of oauth2_proxy for the session store
+func sessionStoreArgs(session models.SessionStoreSettings) []string {
+	if session.Type != SessionStoreRedis {
+		return nil
+	}
+	return []string{
+		fmt.Sprintf("--session-store-type=%s", SessionStoreRedis),
+	}
+}
+
+// sessionStoreEnv - Environment variables of oauth2_proxy for the session store
+func sessionStoreEnv(session models.SessionStoreSettings) []apiv1.EnvVar {
+	if session.Type != SessionStoreRedis {
+		return nil
+	}
+	return []apiv1.EnvVar{
+		apiv1.EnvVar{
+			Name: "OAUTH2_PROXY_REDIS_CONNECTION_URL",
+			ValueFrom: &apiv1.EnvVarSource{
+				SecretKeyRef: &apiv1.SecretKeySelector{
+					LocalObjectReference: apiv1.LocalObjectReference{
+						Name: session.RedisSecretName,
+					},
+					Key: session.RedisSecretKey,
+				},
+			},
+		},
+	}
+}
+
+// managedRedisPassword - requirepass of managed Redis, derived like cookie secrets so that it's stable across restarts
+func (c *Controller) managedRedisPassword() string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte("redis"+c.managedRedisName()+c.Env.CookieSalt)))
+}
+
+// newManagedRedis - Service / Secret / Deployment of single Redis shared by all oauth2_proxy of this manager.
+func (c *Controller) newManagedRedis() (*apiv1.Service, *apiv1.Secret, *appsv1beta2.Deployment) {
+	name := c.managedRedisName()
+	labels := map[string]string{
+		"app": name,
+	}
+
+	service := &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "oauth2-proxy",
+			Labels:    c.Instance.labels(),
+		},
+		Spec: apiv1.ServiceSpec{
+			Type: apiv1.ServiceTypeClusterIP,
+			Ports: []apiv1.ServicePort{
+				apiv1.ServicePort{
+					Name:       "redis",
+					Port:       6379,
+					Protocol:   apiv1.ProtocolTCP,
+					TargetPort: intstr.FromString("redis"),
+				},
+			},
+			Selector: labels,
+		},
+	}
+	password := c.managedRedisPassword()
+	secret := &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "oauth2-proxy",
+			Labels:    c.Instance.labels(),
+		},
+		Type: apiv1.SecretTypeOpaque,
+		StringData: map[string]string{
+			DefaultRedisSecretKey:   fmt.Sprintf("redis://:%s@%s.oauth2-proxy.svc:6379", password, name),
+			managedRedisPasswordKey: password,
+		},
+	}
+	deployment := &appsv1beta2.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "oauth2-proxy",
+			Labels:    c.Instance.labels(),
+		},
+		Spec: appsv1beta2.DeploymentSpec{
+			Replicas: int32Ptr(1),
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: apiv1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: apiv1.PodSpec{
+					Containers: []apiv1.Container{
+						apiv1.Container{
+							Name:  "redis",
+							Image: c.Proxy.RedisImage,
+							Args: []string{
+								// Sessions are disposable, don't persist
+								"--save", "",
+								"--appendonly", "no",
+								"--requirepass", "$(REDIS_PASSWORD)",
+							},
+							Env: []apiv1.EnvVar{
+								apiv1.EnvVar{
+									Name: "REDIS_PASSWORD",
+									ValueFrom: &apiv1.EnvVarSource{
+										SecretKeyRef: &apiv1.SecretKeySelector{
+											LocalObjectReference: apiv1.LocalObjectReference{
+												Name: name,
+											},
+											Key: managedRedisPasswordKey,
+										},
+									},
+								},
+							},
+							Ports: []apiv1.ContainerPort{
+								{
+									Name:          "redis",
+									Protocol:      apiv1.ProtocolTCP,
+									ContainerPort: 6379,
+								},
+							},
+							ReadinessProbe: &apiv1.Probe{
+								Handler: apiv1.Handler{
+									TCPSocket: &apiv1.TCPSocketAction{
+										Port: intstr.FromString("redis"),
+									},
+								},
+							},
+							SecurityContext: hardenedSecurityContext(managedRedisRunAsUser),
+						},
+					},
+				},
+			},
+		},
+	}
+	return service, secret, deployment
+}
+
+// applyManagedRedis - Deploy single Redis shared by all oauth2_proxy of this manager.
+func (c *Controller) applyManagedRedis() {
+	service, secret, deployment := c.newManagedRedis()
+
+	// Service
+	servicesClient := c.Clientset.CoreV1().Services("oauth2-proxy")
+	result, err := servicesClient.Get(c.managedRedisName(), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		logrus.Panic(err)
+	}
+	if apierrors.IsNotFound(err) {
+		if !c.dryRun("Service", nil, service) {
+			logrus.Printf("[redis] Creating Service...")
+			result, err = servicesClient.Create(service)
+			if err != nil {
+				logrus.Panic(err)
+			}
+			logrus.Printf("[redis] Created Service! %q", result.GetObjectMeta().GetName())
+		}
+	} else if !c.dryRun("Service", result, service) {
+		logrus.Printf("[redis] Update Service...")
+		service.Spec.ClusterIP = result.Spec.ClusterIP
+		service.SetResourceVersion(result.GetResourceVersion())
+		result, err = servicesClient.Update(service)
+		if err != nil {
+			logrus.Panic(err)
+		}
+		logrus.Printf("[redis] Updated Service! %q", result.GetObjectMeta().GetName())
+	}
+
+	// Secret
+	secretClient := c.Clientset.CoreV1().Secrets("oauth2-proxy")
+	secretResult, err := secretClient.Get(c.managedRedisName(), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		logrus.Panic(err)
+	}
+	if apierrors.IsNotFound(err) {
+		if !c.dryRun("Secret", nil, secret) {
+			logrus.Printf("[redis] Creating Secret...")
+			secretResult, err = secretClient.Create(secret)
+			if err != nil {
+				logrus.Panic(err)
+			}
+			logrus.Printf("[redis] Created Secret! %q", secretResult.GetObjectMeta().GetName())
+		}
+	} else if !c.dryRun("Secret", secretResult, secret) {
+		logrus.Printf("[redis] Update Secret...")
+		secretResult, err = secretClient.Update(secret)
+		if err != nil {
+			logrus.Panic(err)
+		}
+		logrus.Printf("[redis] Updated Secret! %q", secretResult.GetObjectMeta().GetName())
+	}
+
+	// Deployment
+	deploymentsClient := c.Clientset.AppsV1beta2().Deployments("oauth2-proxy")
+	deploymentResult, err := deploymentsClient.Get(c.managedRedisName(), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		logrus.Panic(err)
+	}
+	if apierrors.IsNotFound(err) {
+		if c.dryRun("Deployment", nil, deployment) {
+			return
+		}
+		logrus.Printf("[redis] Creating Deployment...")
+		deploymentResult, err = deploymentsClient.Create(deployment)
+		if err != nil {
+			logrus.Panic(err)
+		}
+		logrus.Printf("[redis] Created Deployment! %q", deploymentResult.GetObjectMeta().GetName())
+	} else {
+		if c.dryRun("Deployment", deploymentResult, deployment) {
+			return
+		}
+		logrus.Printf("[redis] Update Deployment...")
+		deploymentResult, err = deploymentsClient.Update(deployment)
+		if err != nil {
+			logrus.Panic(err)
+		}
+		logrus.Printf("[redis] Updated Deployment! %q", deploymentResult.GetObjectMeta().GetName())
+	}
+}
+
+// managedRedisUsed - Whether an app applied by this manager stores sessions in managed Redis
+func (c *Controller) managedRedisUsed() bool {
+	for _, app := range c.apps {
+		if spec, err := c.resolve(app); err == nil && spec.SessionStore.RedisSecretName == c.managedRedisName() {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseManagedRedis - Delete managed Redis once no applied app uses it (last app deleted, moved to cookie, or managed Redis disabled)
+func (c *Controller) releaseManagedRedis() {
+	if c.managedRedisUsed() {
+		return
+	}
+	name := c.managedRedisName()
+	exists, err := c.objectExists("Deployment", "oauth2-proxy", name)
+	if err != nil {
+		logrus.Panic(err)
+	}
+	if !exists {
+		return
+	}
+	logrus.Infof("[Controller] Last app of managed Redis(%s) is removed", name)
+	c.deleteObject("Deployment", "oauth2-proxy", name, c.Clientset.AppsV1beta2().Deployments("oauth2-proxy").Delete)
+	c.deleteObject("Secret", "oauth2-proxy", name, c.Clientset.CoreV1().Secrets("oauth2-proxy").Delete)
+	c.deleteObject("Service", "oauth2-proxy", name, c.Clientset.CoreV1().Services("oauth2-proxy").Delete)
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/Laica-Lunasys/oauth2-proxy-manager/models"
+	"github.com/sirupsen/logrus"
+)
+
+// Sharing of oauth2_proxy between apps
+const (
+	// ProxySharingPerApp - Each app has its own oauth2_proxy
+	ProxySharingPerApp = "per-app"
+	// ProxySharingPerOrg - Apps of a GitHub org share one oauth2_proxy, teams of each app are checked by allowed_groups of its auth-url
+	ProxySharingPerOrg = "per-org"
+)
+
+// sharedProxyAppsKey - Annotation of the ConfigMap of shared oauth2_proxy, listing apps served by it ("<app-name>,...").
+// Only for people reading it: apps are tracked by the manager, so the ConfigMap may be recreated.
+const sharedProxyAppsKey = "apps"
+
+// parseProxySharing - Normalize sharing ("Per-Org" => "per-org")
+func parseProxySharing(value string) (string, error) {
+	for _, sharing := range []string{ProxySharingPerApp, ProxySharingPerOrg} {
+		if strings.EqualFold(strings.TrimSpace(value), sharing) {
+			return sharing, nil
+		}
+	}
+	return "", fmt.Errorf("sharing %q is invalid: must be %s or %s", value, ProxySharingPerApp, ProxySharingPerOrg)
+}
+
+// proxySharing - Sharing of oauth2_proxy of the app (annotation > global)
+func (c *Controller) proxySharing(settings *models.ServiceSettings) string {
+	if len(settings.Sharing) != 0 {
+		return settings.Sharing
+	}
+	if len(c.Proxy.Sharing) != 0 {
+		return c.Proxy.Sharing
+	}
+	return ProxySharingPerApp
+}
+
+// orgProxy - Settings of oauth2_proxy shared by apps of the org of settings.
+// Only global settings apply to it: it's served on OAUTH2_PROXY_DOMAIN, with the version / tuning / session store of the manager.
+func orgProxy(settings *models.ServiceSettings) *models.ServiceSettings {
+	return &models.ServiceSettings{
+		Instance:          settings.Instance,
+		IngressController: settings.IngressController,
+		GitHub: models.GitHubProvider{
+			Organization: settings.GitHub.Organization,
+		},
+	}
+}
+
+// servingProxy - Settings of oauth2_proxy serving the app: the app itself, or oauth2_proxy shared by its org
+func (c *Controller) servingProxy(settings *models.ServiceSettings) *models.ServiceSettings {
+	if c.proxySharing(settings) == ProxySharingPerOrg {
+		return orgProxy(settings)
+	}
+	return settings
+}
+
+// servingProxyName - Name of objects of oauth2_proxy serving the app
+func (c *Controller) servingProxyName(settings *models.ServiceSettings) string {
+	c.settingsMu.RLock()
+	defer c.settingsMu.RUnlock()
+	return proxyName(c.servingProxy(settings))
+}
+
+// sharedProxyConflicts - Annotations of the app configuring its own oauth2_proxy, which can't apply to shared one
+func sharedProxyConflicts(settings *models.ServiceSettings) []string {
+	conflicts := []string{}
+	for _, field := range []struct {
+		key string
+		set bool
+	}{
+		{"auth-host", len(settings.AuthHost) != 0},
+		{"auth-tls-secret", len(settings.AuthTLSSecretName) != 0},
+		{"cookie-domain", len(settings.CookieDomain) != 0},
+		{"whitelist-domain", len(settings.WhitelistDomain) != 0},
+		{"set-xauthrequest", len(settings.SetXAuthRequest) != 0},
+		{"image", len(settings.Image) != 0},
+		{"version", len(settings.Version) != 0},
+		{"service-type", len(settings.ServiceType) != 0},
+		{"Deployment tuning", !reflect.DeepEqual(settings.Deployment, models.DeploymentSettings{})},
+		{"session store", !reflect.DeepEqual(settings.SessionStore, models.SessionStoreSettings{})},
+	} {
+		if field.set {
+			conflicts = append(conflicts, field.key)
+		}
+	}
+	return conflicts
+}
+
+// allowedGroups - GitHub teams of the app as groups of oauth2_proxy ("example-corp:admin,example-corp:dev")
+func allowedGroups(settings *models.ServiceSettings) string {
+	groups := []string{}
+	for _, team := range settings.GitHub.Teams {
+		groups = append(groups, settings.GitHub.Organization+":"+team)
+	}
+	return strings.Join(groups, ",")
+}
+
+// sharedProxyApps - Applied apps served by oauth2_proxy shared by the org of settings
+func (c *Controller) sharedProxyApps(settings *models.ServiceSettings) []string {
+	name := proxyName(orgProxy(settings))
+	apps := []string{}
+	for _, app := range c.apps {
+		if proxyName(c.servingProxy(app)) == name {
+			apps = append(apps, app.AppName)
+		}
+	}
+	sort.Strings(apps)
+	return apps
+}
+
+// joinSharedProxy - Record the app in ConfigMap of oauth2_proxy shared by its org
+func (c *Controller) joinSharedProxy(settings *models.ServiceSettings) {
+	c.updateSharedProxyApps(settings)
+}
+
+// leaveSharedProxy - Remove the app from oauth2_proxy shared by its org, if any. Shared oauth2_proxy without apps is deleted.
+func (c *Controller) leaveSharedProxy(settings *models.ServiceSettings) {
+	if empty := c.updateSharedProxyApps(settings); empty {
+		proxy := orgProxy(settings)
+		logrus.Infof("[Controller] Last app of oauth2_proxy(%s) is removed", proxyName(proxy))
+		c.deleteProxy(proxy)
+	}
+}
+
+// updateSharedProxyApps - Record applied apps of shared oauth2_proxy of the org in its ConfigMap. Returns whether no app is left.
+// Nothing is done if the shared oauth2_proxy doesn't exist.
+func (c *Controller) updateSharedProxyApps(settings *models.ServiceSettings) bool {
+	configMapClient := c.Clientset.CoreV1().ConfigMaps("oauth2-proxy")
+	name := proxyName(orgProxy(settings))
+	key := c.Instance.AnnotationPrefix + "/" + sharedProxyAppsKey
+	apps := c.sharedProxyApps(settings)
+
+	exists := false
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		result, err := configMapClient.Get(name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		exists = true
+		if len(apps) == 0 || strings.Join(apps, ",") == result.Annotations[key] {
+			return nil
+		}
+
+		configMap := result.DeepCopy()
+		if configMap.Annotations == nil {
+			configMap.Annotations = map[string]string{}
+		}
+		configMap.Annotations[key] = strings.Join(apps, ",")
+		if c.dryRun("ConfigMap", result, configMap) {
+			return nil
+		}
+		logrus.Printf("[oauth2_proxy] Update apps of ConfigMap...")
+		result, err = configMapClient.Update(configMap)
+		if err != nil {
+			return err
+		}
+		logrus.Printf("[oauth2_proxy] Updated ConfigMap! %q", result.GetObjectMeta().GetName())
+		return nil
+	})
+	if err != nil {
+		logrus.Panic(err)
+	}
+	return exists && len(apps) == 0
+}
+
+// checkSharedAuthURL - Warn if auth-url of the Ingress doesn't point to oauth2_proxy shared by the org with teams of the app.
+// Without allowed_groups, every member of the org passes.
+func (ob *Observer) checkSharedAuthURL(key string, settings *models.ServiceSettings) {
+	if len(settings.AuthURL) == 0 || ob.Controller.servingProxyName(settings) == proxyName(settings) {
+		return
+	}
+	authURL, _ := ob.Controller.authURLs(settings)
+	if err := checkAuthURL(settings.AuthURL, authURL); err != nil {
+		logrus.Warnf("[Observer] Ingress %s: auth-url %s", key, err)
+	}
+}
@@ -0,0 +1,334 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"github.com/Laica-Lunasys/oauth2-proxy-manager/models"
+	"github.com/sirupsen/logrus"
+)
+
+// Injected oauth2_proxy sidecar, for workloads not exposed through Ingress (internal gRPC-web, port-forwarded dashboards)
+const (
+	// sidecarContainerName - Name of injected container, also used to detect Pods injected already
+	sidecarContainerName = "oauth2-proxy"
+	// sidecarPortName - Port of injected container. "http" is likely taken by the app.
+	sidecarPortName = "oauth2-proxy"
+	// sidecarVolumeName - Volume of oauth2_proxy.cfg, apart from volumes of the app
+	sidecarVolumeName = "oauth2-proxy-config"
+	// DefaultSidecarPort - Port oauth2_proxy sidecar listens on
+	DefaultSidecarPort = 4180
+	// sidecarGracePeriod - Secret / ConfigMap applied for a Pod are kept this long, until the Pod is created
+	sidecarGracePeriod = 5 * time.Minute
+	// sidecarCleanupPeriod - Interval to delete Secrets / ConfigMaps of sidecars not used by any Pod
+	sidecarCleanupPeriod = 10 * time.Minute
+	// sidecarLabel - Label of Secrets / ConfigMaps applied for sidecars. Only these are deleted by cleanup.
+	sidecarLabel = "oauth2-proxy-manager.k8s.io/sidecar"
+)
+
+// SidecarOption - oauth2_proxy sidecar requested by annotations of the Pod (or Pod template of Deployment)
+type SidecarOption struct {
+	// UpstreamPort - Port of the app, proxied as http://127.0.0.1:<port>
+	UpstreamPort int32
+	// Port - Port oauth2_proxy listens on (default: 4180)
+	Port int32
+	// RedirectURL - OAuth callback URL (e.g. https://dashboard.example.com/oauth2/callback). Derived from the request if empty.
+	RedirectURL string
+}
+
+// parseSidecarOption - Sidecar of the Pod. false is returned if the Pod doesn't ask for it (sidecar: "true").
+func parseSidecarOption(lookup lookupFunc) (SidecarOption, bool, error) {
+	option := SidecarOption{Port: DefaultSidecarPort}
+	enabled, err := lookupBool(lookup, "sidecar")
+	if err != nil {
+		return option, true, err
+	}
+	if enabled == nil || !*enabled {
+		return option, false, nil
+	}
+
+	upstreamPort, err := lookupInt32(lookup, "sidecar-upstream-port", 1)
+	if err != nil {
+		return option, true, err
+	}
+	if upstreamPort == nil {
+		return option, true, errors.New("sidecar-upstream-port not found. skip.")
+	}
+	option.UpstreamPort = *upstreamPort
+
+	port, err := lookupInt32(lookup, "sidecar-port", 1)
+	if err != nil {
+		return option, true, err
+	}
+	if port != nil {
+		option.Port = *port
+	}
+	if option.Port == option.UpstreamPort {
+		return option, true, fmt.Errorf("sidecar-port %d is used by sidecar-upstream-port", option.Port)
+	}
+
+	option.RedirectURL, _ = lookup("sidecar-redirect-url")
+	option.RedirectURL = strings.TrimSpace(option.RedirectURL)
+	return option, true, nil
+}
+
+// InjectSidecar - oauth2_proxy container and its config volume for a Pod of the app in namespace.
+// Secret / ConfigMap of the app are applied in namespace, as for oauth2_proxy Deployment; nothing is written on dryRun.
+// API errors are returned, so that the Pod is denied instead of failing the admission request.
+func (c *Controller) InjectSidecar(namespace string, settings *models.ServiceSettings, sidecar SidecarOption, dryRun bool) (*apiv1.Container, *apiv1.Volume, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.report = dryRunReport{}
+	defer c.logDryRunReport(settings)
+
+	if namespace == "oauth2-proxy" {
+		return nil, nil, errors.New("oauth2_proxy sidecar can't be injected in oauth2-proxy namespace: Secrets / ConfigMaps of oauth2_proxy Deployments are there")
+	}
+
+	// Sidecar serves only its Pod
+	app := *settings
+	app.Sharing = ProxySharingPerApp
+	spec, err := c.resolve(&app)
+	if err != nil {
+		return nil, nil, err
+	}
+	if spec.SessionStore.RedisSecretName == c.managedRedisName() {
+		return nil, nil, errors.New("managed Redis can't be used by sidecar: its Secret is in oauth2-proxy namespace")
+	}
+
+	if !dryRun {
+		logrus.Infof("[Controller] Applying Secret / ConfigMap of oauth2_proxy(%s) sidecar in %s...", app.AppName, namespace)
+		secret := c.newSecret(namespace, &app, spec)
+		secret.Labels[sidecarLabel] = "true"
+		if err := c.applySecretObject(secret); err != nil {
+			return nil, nil, fmt.Errorf("failed to apply Secret of sidecar: %s", err)
+		}
+		configMap := c.newConfigMap(namespace, &app)
+		configMap.Labels[sidecarLabel] = "true"
+		if err := c.applyConfigMapObject(configMap); err != nil {
+			return nil, nil, fmt.Errorf("failed to apply ConfigMap of sidecar: %s", err)
+		}
+		if c.sidecars == nil {
+			c.sidecars = map[string]time.Time{}
+		}
+		c.sidecars[namespace+"/"+proxyName(&app)] = time.Now()
+	}
+	container := c.newSidecarContainer(&app, spec, sidecar)
+	volume := proxyConfigVolume(sidecarVolumeName, &app)
+	return &container, &volume, nil
+}
+
+// newSidecarContainer - oauth2_proxy container in front of the app on 127.0.0.1, served on /oauth2 of the host of the app
+func (c *Controller) newSidecarContainer(settings *models.ServiceSettings, spec proxySpec, sidecar SidecarOption) apiv1.Container {
+	container := c.newProxyContainer(settings, spec)
+
+	args := []string{}
+	for _, arg := range container.Args {
+		switch strings.SplitN(arg, "=", 2)[0] {
+		case "--http-address", "--cookie-domain", "--proxy-prefix", "--redirect-url", "--upstream":
+			continue
+		}
+		args = append(args, arg)
+	}
+	args = append(args,
+		fmt.Sprintf("--http-address=0.0.0.0:%d", sidecar.Port),
+		fmt.Sprintf("--upstream=http://127.0.0.1:%d", sidecar.UpstreamPort),
+	)
+	// Cookie of the host of the app, unless cookie-domain is set
+	if len(settings.CookieDomain) != 0 {
+		args = append(args, fmt.Sprintf("--cookie-domain=%s", settings.CookieDomain))
+	}
+	if len(sidecar.RedirectURL) != 0 {
+		args = append(args, fmt.Sprintf("--redirect-url=%s", sidecar.RedirectURL))
+	}
+	container.Args = args
+
+	container.Ports = []apiv1.ContainerPort{
+		{
+			Name:          sidecarPortName,
+			Protocol:      apiv1.ProtocolTCP,
+			ContainerPort: sidecar.Port,
+		},
+	}
+	container.LivenessProbe.Handler.HTTPGet.Port = intstr.FromString(sidecarPortName)
+	container.ReadinessProbe.Handler.HTTPGet.Port = intstr.FromString(sidecarPortName)
+	container.VolumeMounts[0].Name = sidecarVolumeName
+	return container
+}
+
+// inject - Add oauth2_proxy sidecar to Pods asking for it (sidecar: "true")
+func (wh *Webhook) inject(request *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	if request.Operation != admissionv1beta1.Create {
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+	pod := &apiv1.Pod{}
+	if err := json.Unmarshal(request.Object.Raw, pod); err != nil {
+		return deny(fmt.Sprintf("failed to decode Pod: %s", err))
+	}
+	key := request.Namespace + "/" + pod.Name
+	if len(pod.Name) == 0 {
+		// Pods of ReplicaSet are named by API server
+		key = request.Namespace + "/" + pod.GenerateName
+	}
+
+	instance := wh.Observer.Controller.Instance
+	lookup := annotationLookup(pod.Annotations, instance.AnnotationPrefix)
+	sidecar, enabled, err := parseSidecarOption(lookup)
+	if !enabled {
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+	if err != nil {
+		return deny(strings.TrimSuffix(err.Error(), " skip."))
+	}
+	// Client secret of the OAuth App is only written in namespaces observed by the manager
+	if !wh.Observer.namespaceObserved(request.Namespace) {
+		return deny(fmt.Sprintf("namespace %s is not observed by oauth2-proxy-manager: oauth2_proxy sidecar can't be injected", request.Namespace))
+	}
+	for _, container := range pod.Spec.Containers {
+		if container.Name == sidecarContainerName {
+			return &admissionv1beta1.AdmissionResponse{Allowed: true}
+		}
+	}
+	if err := checkAppClaimed(lookup); err != nil {
+		return deny(strings.TrimSuffix(err.Error(), " skip."))
+	}
+	settings, err := parseAppSettings(instance, lookup)
+	if err != nil {
+		return deny(err.Error())
+	}
+
+	dryRun := request.DryRun != nil && *request.DryRun
+	container, volume, err := wh.Observer.Controller.InjectSidecar(request.Namespace, settings, sidecar, dryRun)
+	if err != nil {
+		return deny(err.Error())
+	}
+	if wh.Observer.Controller.DryRun {
+		// Secret / ConfigMap are not written: the sidecar couldn't start
+		logrus.Infof("[dry-run] Would inject oauth2_proxy(%s) sidecar into Pod %s", settings.AppName, key)
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+
+	patch := []map[string]interface{}{
+		{"op": "add", "path": "/spec/containers/-", "value": container},
+	}
+	if len(pod.Spec.Volumes) == 0 {
+		patch = append(patch, map[string]interface{}{"op": "add", "path": "/spec/volumes", "value": []apiv1.Volume{*volume}})
+	} else {
+		patch = append(patch, map[string]interface{}{"op": "add", "path": "/spec/volumes/-", "value": volume})
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return deny(err.Error())
+	}
+	logrus.Infof("[Webhook] Injecting oauth2_proxy(%s) sidecar into Pod %s", settings.AppName, key)
+	patchType := admissionv1beta1.PatchTypeJSONPatch
+	return &admissionv1beta1.AdmissionResponse{
+		Allowed:   true,
+		Patch:     data,
+		PatchType: &patchType,
+	}
+}
+
+// runSidecarCleanup - Delete Secrets / ConfigMaps of sidecars not used anymore, every sidecarCleanupPeriod
+func (wh *Webhook) runSidecarCleanup() {
+	for range time.Tick(sidecarCleanupPeriod) {
+		wh.CleanupSidecars()
+	}
+}
+
+// CleanupSidecars - Delete Secrets / ConfigMaps applied for sidecars in observed namespaces, which no Pod uses anymore
+func (wh *Webhook) CleanupSidecars() {
+	ob := wh.Observer
+	namespaces := ob.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	for _, namespace := range namespaces {
+		unused, err := ob.Controller.unusedSidecars(namespace)
+		if err != nil {
+			logrus.Errorf("[Webhook] Failed to find unused oauth2_proxy sidecars: %s", err)
+			continue
+		}
+		for _, key := range unused {
+			kv := strings.SplitN(key, "/", 2)
+			if !ob.namespaceObserved(kv[0]) {
+				continue
+			}
+			ob.Controller.deleteSidecar(kv[0], kv[1])
+		}
+	}
+}
+
+// unusedSidecars - "<namespace>/<name>" of Secrets / ConfigMaps of sidecars in namespace, not mounted by any Pod
+func (c *Controller) unusedSidecars(namespace string) ([]string, error) {
+	selector := labels.Set(c.Instance.labels())
+	selector[sidecarLabel] = "true"
+	options := metav1.ListOptions{LabelSelector: labels.SelectorFromSet(selector).String()}
+	secrets, err := c.Clientset.CoreV1().Secrets(namespace).List(options)
+	if err != nil {
+		return nil, err
+	}
+	configMaps, err := c.Clientset.CoreV1().ConfigMaps(namespace).List(options)
+	if err != nil {
+		return nil, err
+	}
+	pods, err := c.Clientset.CoreV1().Pods(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	used := map[string]bool{}
+	for _, pod := range pods.Items {
+		for _, volume := range pod.Spec.Volumes {
+			if volume.Name == sidecarVolumeName && volume.ConfigMap != nil {
+				used[pod.Namespace+"/"+volume.ConfigMap.Name] = true
+			}
+		}
+	}
+	unused := []string{}
+	found := map[string]bool{}
+	objects := []metav1.ObjectMeta{}
+	for _, secret := range secrets.Items {
+		objects = append(objects, secret.ObjectMeta)
+	}
+	for _, configMap := range configMaps.Items {
+		objects = append(objects, configMap.ObjectMeta)
+	}
+	for _, meta := range objects {
+		key := meta.Namespace + "/" + meta.Name
+		if used[key] || found[key] {
+			continue
+		}
+		found[key] = true
+		unused = append(unused, key)
+	}
+	return unused, nil
+}
+
+// deleteSidecar - Delete Secret / ConfigMap of sidecar, unless they were applied for a Pod just now (the Pod may not be created yet)
+func (c *Controller) deleteSidecar(namespace string, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := namespace + "/" + name
+	if injected, ok := c.sidecars[key]; ok && time.Since(injected) < sidecarGracePeriod {
+		return
+	}
+	delete(c.sidecars, key)
+
+	logrus.Infof("[Controller] oauth2_proxy sidecar %s is not used by any Pod, deleting Secret / ConfigMap...", key)
+	if err := c.deleteObjectAt("ConfigMap", namespace, name, "", c.Clientset.CoreV1().ConfigMaps(namespace).Delete); err != nil {
+		logrus.Errorf("[Controller] Failed to delete ConfigMap %s: %s", key, err)
+	}
+	if err := c.deleteObjectAt("Secret", namespace, name, "", c.Clientset.CoreV1().Secrets(namespace).Delete); err != nil {
+		logrus.Errorf("[Controller] Failed to delete Secret %s: %s", key, err)
+	}
+}
@@ -0,0 +1,282 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"github.com/Laica-Lunasys/oauth2-proxy-manager/models"
+)
+
+// DefaultRunAsUser - UID of oauth2_proxy container
+const DefaultRunAsUser = 2000
+
+// lookupFunc - Find a tuning value by its annotation name (e.g. "cpu-request")
+type lookupFunc func(key string) (string, bool)
+
+// annotationLookup - "cpu-request" => <prefix>/cpu-request (e.g. oauth2-proxy-manager.k8s.io/cpu-request)
+func annotationLookup(annotations map[string]string, prefix string) lookupFunc {
+	return func(key string) (string, bool) {
+		value, ok := annotations[prefix+"/"+key]
+		return value, ok
+	}
+}
+
+// parseDeploymentSettings - Parse Deployment tuning from annotations or environment variables.
+func parseDeploymentSettings(lookup lookupFunc) (models.DeploymentSettings, error) {
+	settings := models.DeploymentSettings{}
+
+	var err error
+	if settings.Replicas, err = lookupInt32(lookup, "replicas", 0); err != nil {
+		return settings, err
+	}
+
+	quantities := []struct {
+		key  string
+		list *apiv1.ResourceList
+		name apiv1.ResourceName
+	}{
+		{"cpu-request", &settings.Resources.Requests, apiv1.ResourceCPU},
+		{"memory-request", &settings.Resources.Requests, apiv1.ResourceMemory},
+		{"cpu-limit", &settings.Resources.Limits, apiv1.ResourceCPU},
+		{"memory-limit", &settings.Resources.Limits, apiv1.ResourceMemory},
+	}
+	for _, q := range quantities {
+		value, ok := lookup(q.key)
+		if !ok {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return settings, fmt.Errorf("%s %q is invalid: %s", q.key, value, err)
+		}
+		if *q.list == nil {
+			*q.list = apiv1.ResourceList{}
+		}
+		(*q.list)[q.name] = quantity
+	}
+
+	if value, ok := lookup("node-selector"); ok {
+		nodeSelector := map[string]string{}
+		for _, pair := range strings.Split(value, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 {
+				return settings, fmt.Errorf("node-selector %q is invalid: expected key=value[,key=value]", value)
+			}
+			nodeSelector[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+		settings.NodeSelector = nodeSelector
+	}
+
+	if value, ok := lookup("tolerations"); ok {
+		if err := json.Unmarshal([]byte(value), &settings.Tolerations); err != nil {
+			return settings, fmt.Errorf("tolerations is invalid: %s", err)
+		}
+	}
+
+	if value, ok := lookup("affinity"); ok {
+		settings.Affinity = &apiv1.Affinity{}
+		if err := json.Unmarshal([]byte(value), settings.Affinity); err != nil {
+			return settings, fmt.Errorf("affinity is invalid: %s", err)
+		}
+	}
+
+	if value, ok := lookup("spread-topology-key"); ok {
+		settings.SpreadTopologyKey = value
+	}
+
+	// PodDisruptionBudget
+	if settings.Disruption.Enabled, err = lookupBool(lookup, "pdb"); err != nil {
+		return settings, err
+	}
+	if settings.Disruption.MinAvailable, err = lookupIntOrPercent(lookup, "pdb-min-available"); err != nil {
+		return settings, err
+	}
+	if settings.Disruption.MaxUnavailable, err = lookupIntOrPercent(lookup, "pdb-max-unavailable"); err != nil {
+		return settings, err
+	}
+	if settings.Disruption.MinAvailable != nil && settings.Disruption.MaxUnavailable != nil {
+		return settings, fmt.Errorf("pdb-min-available and pdb-max-unavailable are exclusive")
+	}
+
+	// HorizontalPodAutoscaler
+	if settings.Autoscaling.Enabled, err = lookupBool(lookup, "hpa"); err != nil {
+		return settings, err
+	}
+	if settings.Autoscaling.MinReplicas, err = lookupInt32(lookup, "hpa-min-replicas", 1); err != nil {
+		return settings, err
+	}
+	if settings.Autoscaling.MaxReplicas, err = lookupInt32(lookup, "hpa-max-replicas", 1); err != nil {
+		return settings, err
+	}
+	if settings.Autoscaling.TargetCPUUtilization, err = lookupInt32(lookup, "hpa-target-cpu", 1); err != nil {
+		return settings, err
+	}
+	if err := validateDeploymentSettings(settings); err != nil {
+		return settings, err
+	}
+
+	return settings, nil
+}
+
+// validateDeploymentSettings - Settings HorizontalPodAutoscaler can't work with. Checked on annotations, and again after merged with global defaults.
+func validateDeploymentSettings(settings models.DeploymentSettings) error {
+	if autoscalingEnabled(settings) && settings.Replicas != nil && *settings.Replicas == 0 && settings.Autoscaling.MinReplicas == nil {
+		return fmt.Errorf("replicas 0 can't be used with hpa: set hpa-min-replicas >= 1")
+	}
+	return nil
+}
+
+func lookupInt32(lookup lookupFunc, key string, min int64) (*int32, error) {
+	value, ok := lookup(key)
+	if !ok {
+		return nil, nil
+	}
+	i, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || i < min {
+		return nil, fmt.Errorf("%s %q is invalid: must be integer >= %d", key, value, min)
+	}
+	return int32Ptr(int32(i)), nil
+}
+
+func lookupBool(lookup lookupFunc, key string) (*bool, error) {
+	value, ok := lookup(key)
+	if !ok {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s %q is invalid: must be true or false", key, value)
+	}
+	return &b, nil
+}
+
+// lookupIntOrPercent - "1" or "50%"
+func lookupIntOrPercent(lookup lookupFunc, key string) (*intstr.IntOrString, error) {
+	value, ok := lookup(key)
+	if !ok {
+		return nil, nil
+	}
+	if strings.HasSuffix(value, "%") {
+		if _, err := strconv.Atoi(strings.TrimSuffix(value, "%")); err != nil {
+			return nil, fmt.Errorf("%s %q is invalid: must be integer or percentage", key, value)
+		}
+		v := intstr.FromString(value)
+		return &v, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		return nil, fmt.Errorf("%s %q is invalid: must be integer or percentage", key, value)
+	}
+	v := intstr.FromInt(i)
+	return &v, nil
+}
+
+// mergeDeploymentSettings - Per-app settings override global defaults field by field.
+func mergeDeploymentSettings(defaults, app models.DeploymentSettings) models.DeploymentSettings {
+	merged := defaults
+	if app.Replicas != nil {
+		merged.Replicas = app.Replicas
+	}
+	merged.Resources = apiv1.ResourceRequirements{
+		Requests: mergeResourceList(defaults.Resources.Requests, app.Resources.Requests),
+		Limits:   mergeResourceList(defaults.Resources.Limits, app.Resources.Limits),
+	}
+	if app.NodeSelector != nil {
+		merged.NodeSelector = app.NodeSelector
+	}
+	if app.Tolerations != nil {
+		merged.Tolerations = app.Tolerations
+	}
+	if app.Affinity != nil {
+		merged.Affinity = app.Affinity
+	}
+	if len(app.SpreadTopologyKey) != 0 {
+		merged.SpreadTopologyKey = app.SpreadTopologyKey
+	}
+
+	if app.Disruption.Enabled != nil {
+		merged.Disruption.Enabled = app.Disruption.Enabled
+	}
+	if app.Disruption.MinAvailable != nil || app.Disruption.MaxUnavailable != nil {
+		merged.Disruption.MinAvailable = app.Disruption.MinAvailable
+		merged.Disruption.MaxUnavailable = app.Disruption.MaxUnavailable
+	}
+
+	if app.Autoscaling.Enabled != nil {
+		merged.Autoscaling.Enabled = app.Autoscaling.Enabled
+	}
+	if app.Autoscaling.MinReplicas != nil {
+		merged.Autoscaling.MinReplicas = app.Autoscaling.MinReplicas
+	}
+	if app.Autoscaling.MaxReplicas != nil {
+		merged.Autoscaling.MaxReplicas = app.Autoscaling.MaxReplicas
+	}
+	if app.Autoscaling.TargetCPUUtilization != nil {
+		merged.Autoscaling.TargetCPUUtilization = app.Autoscaling.TargetCPUUtilization
+	}
+	return merged
+}
+
+func mergeResourceList(defaults, app apiv1.ResourceList) apiv1.ResourceList {
+	if defaults == nil && app == nil {
+		return nil
+	}
+	merged := apiv1.ResourceList{}
+	for name, quantity := range defaults {
+		merged[name] = quantity
+	}
+	for name, quantity := range app {
+		merged[name] = quantity
+	}
+	return merged
+}
+
+// spreadAffinity - Add preferred anti-affinity so replicas spread over topologyKey.
+func spreadAffinity(affinity *apiv1.Affinity, topologyKey string, labels map[string]string) *apiv1.Affinity {
+	if len(topologyKey) == 0 || topologyKey == "none" {
+		return affinity
+	}
+	if affinity == nil {
+		affinity = &apiv1.Affinity{}
+	} else {
+		affinity = affinity.DeepCopy()
+	}
+	if affinity.PodAntiAffinity == nil {
+		affinity.PodAntiAffinity = &apiv1.PodAntiAffinity{}
+	}
+	affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution = append(
+		affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution,
+		apiv1.WeightedPodAffinityTerm{
+			Weight: 100,
+			PodAffinityTerm: apiv1.PodAffinityTerm{
+				LabelSelector: &metav1.LabelSelector{
+					MatchLabels: labels,
+				},
+				TopologyKey: topologyKey,
+			},
+		},
+	)
+	return affinity
+}
+
+// hardenedSecurityContext - Run oauth2_proxy as non-root with read-only root filesystem.
+func hardenedSecurityContext(runAsUser int64) *apiv1.SecurityContext {
+	return &apiv1.SecurityContext{
+		RunAsUser:                &runAsUser,
+		RunAsNonRoot:             boolPtr(true),
+		ReadOnlyRootFilesystem:   boolPtr(true),
+		AllowPrivilegeEscalation: boolPtr(false),
+		Capabilities: &apiv1.Capabilities{
+			Drop: []apiv1.Capability{"ALL"},
+		},
+	}
+}
+
+func boolPtr(b bool) *bool { return &b }
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultProxyVersion - oauth2_proxy version used when nothing is configured.
+const DefaultProxyVersion = "v3.2.0"
+
+// proxyRelease - Differences between oauth2_proxy major versions.
+// Flags used by the manager (--github-team, --whitelist-domain, ...) have the same names in all of them.
+type proxyRelease struct {
+	// Repository - Default image repository of this release line.
+	Repository string
+	// CookieSecretLength - Required cookie secret length in bytes. (0: any length)
+	CookieSecretLength int
+	// SessionStore - Supports --session-store-type (redis)
+	SessionStore bool
+	// AllowedGroups - auth endpoint checks allowed_groups query (GitHub teams are groups "<org>:<team>")
+	AllowedGroups bool
+}
+
+// proxyReleases - Supported oauth2_proxy major versions.
+// Versions not listed here are refused, because they're not tested with the flags of the manager.
+var proxyReleases = map[int]proxyRelease{
+	3: {
+		Repository: "quay.io/pusher/oauth2_proxy",
+	},
+	4: {
+		Repository:   "quay.io/pusher/oauth2_proxy",
+		SessionStore: true,
+	},
+	5: {
+		Repository:   "quay.io/pusher/oauth2_proxy",
+		SessionStore: true,
+	},
+	6: {
+		Repository:         "quay.io/oauth2-proxy/oauth2-proxy",
+		CookieSecretLength: 32,
+		SessionStore:       true,
+	},
+	7: {
+		Repository:         "quay.io/oauth2-proxy/oauth2-proxy",
+		CookieSecretLength: 32,
+		SessionStore:       true,
+		AllowedGroups:      true,
+	},
+}
+
+// majorVersion - Extract major version from "v7.2.1" / "7.2.1"
+func majorVersion(version string) (int, error) {
+	v := strings.TrimPrefix(strings.TrimSpace(version), "v")
+	major, err := strconv.Atoi(strings.SplitN(v, ".", 2)[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid oauth2_proxy version %q", version)
+	}
+	return major, nil
+}
+
+// validateImageRepository - Image is a repository, tagged with the version of oauth2_proxy.
+// Tag or digest can't be set there ("repo:v7.1.3" would become "repo:v7.1.3:v7.1.3").
+func validateImageRepository(name, value string) error {
+	last := value[strings.LastIndex(value, "/")+1:]
+	if strings.Contains(value, "@") || strings.Contains(last, ":") {
+		return fmt.Errorf("%s %q is invalid: must be repository without tag or digest (use version)", name, value)
+	}
+	return nil
+}
+
+// lookupRelease - Find the release line of given oauth2_proxy version.
+func lookupRelease(version string) (proxyRelease, error) {
+	major, err := majorVersion(version)
+	if err != nil {
+		return proxyRelease{}, err
+	}
+	release, ok := proxyReleases[major]
+	if !ok {
+		return proxyRelease{}, fmt.Errorf("unsupported oauth2_proxy version %q", version)
+	}
+	return release, nil
+}
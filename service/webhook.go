@@ -0,0 +1,264 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/Laica-Lunasys/oauth2-proxy-manager/models"
+	"github.com/sirupsen/logrus"
+)
+
+// Webhook - Admission webhook checking Ingresses protected by this manager when they're written,
+// instead of skipping them later with a warning in logs.
+type Webhook struct {
+	// Observer - Observed Ingresses, to find app-name collisions
+	Observer *Observer
+}
+
+func NewWebhook(observer *Observer) *Webhook {
+	return &Webhook{Observer: observer}
+}
+
+// Handler - /validate (ValidatingWebhookConfiguration), /mutate and /inject (MutatingWebhookConfiguration) and /healthz
+func (wh *Webhook) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate", wh.serve(wh.validate))
+	mux.HandleFunc("/mutate", wh.serve(wh.mutate))
+	mux.HandleFunc("/inject", wh.serve(wh.inject))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	return mux
+}
+
+// Run - Serve webhook over HTTPS, required by API server
+func (wh *Webhook) Run(addr string, certFile string, keyFile string) error {
+	logrus.Infof("[Webhook] Serving admission webhook on %s...", addr)
+	go wh.runSidecarCleanup()
+	server := &http.Server{Addr: addr, Handler: wh.Handler()}
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// serve - Decode AdmissionReview, and respond with the result of review
+func (wh *Webhook) serve(review func(request *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		admissionReview := &admissionv1beta1.AdmissionReview{}
+		if err := json.Unmarshal(body, admissionReview); err != nil || admissionReview.Request == nil {
+			http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+			return
+		}
+
+		response := review(admissionReview.Request)
+		response.UID = admissionReview.Request.UID
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&admissionv1beta1.AdmissionReview{
+			TypeMeta: admissionReview.TypeMeta,
+			Response: response,
+		}); err != nil {
+			logrus.Errorf("[Webhook] Failed to write response: %s", err)
+		}
+	}
+}
+
+// validate - Reject Ingress claimed by this instance with invalid annotations, app-name used by another Ingress,
+// or auth-url / auth-signin not pointing to its oauth2_proxy
+func (wh *Webhook) validate(request *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	if request.Operation == admissionv1beta1.Delete {
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+	ingress, err := decodeIngress(request)
+	if err != nil {
+		return deny(err.Error())
+	}
+	key := ingress.Namespace + "/" + ingress.Name
+	if !wh.Observer.ingressObserved(ingress) {
+		// Owned by another manager (e.g. sharded by namespace)
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+	instance := wh.Observer.Controller.Instance
+
+	lookup := annotationLookup(ingress.Annotations, instance.AnnotationPrefix)
+	adapter := instance.ingressAdapter(ingress.Annotations["kubernetes.io/ingress.class"])
+	if _, ok := lookup("app-name"); !ok || adapter == nil {
+		// Not protected by this instance
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+	if _, err := checkClaimed(ingress.ObjectMeta, instance, lookup); err != nil {
+		return deny(strings.TrimSuffix(err.Error(), ". skip.") + " (required to protect Ingress with oauth2-proxy-manager)")
+	}
+	settings, err := parseAnnotations(ingress.ObjectMeta, instance)
+	if err != nil {
+		return deny(strings.TrimSuffix(err.Error(), ". skip."))
+	}
+
+	// Each app has one oauth2_proxy: another Ingress with the same app would overwrite it
+	for _, other := range wh.Observer.ingresses("") {
+		if other.Namespace == ingress.Namespace && other.Name == ingress.Name {
+			continue
+		}
+		if identity, err := parseIdentity(other.ObjectMeta, instance); err == nil && proxyName(identity) == proxyName(settings) {
+			return deny(fmt.Sprintf("app-name %q of github-org %q is already used by Ingress %s/%s", settings.AppName, settings.GitHub.Organization, other.Namespace, other.Name))
+		}
+	}
+
+	actualURL, actualSignIn, err := adapter.authURLs(ingress, wh.Observer.Controller.Dynamic)
+	if err != nil {
+		return deny(err.Error())
+	}
+	authURL, authSignIn := wh.Observer.Controller.authURLs(settings)
+	errs := []string{}
+	if err := checkAuthURL(actualURL, authURL); err != nil {
+		errs = append(errs, fmt.Sprintf("auth-url %s", err))
+	}
+	// Without sign-in redirect (Traefik), there's nothing to check
+	if len(authSignIn) != 0 {
+		if err := checkAuthURL(actualSignIn, authSignIn); err != nil {
+			errs = append(errs, fmt.Sprintf("auth-signin %s", err))
+		}
+	}
+	if len(errs) != 0 {
+		return deny(strings.Join(errs, ", "))
+	}
+
+	logrus.Debugf("[Webhook] Ingress %s is valid", key)
+	return &admissionv1beta1.AdmissionResponse{Allowed: true}
+}
+
+// mutate - Fill auth-url / auth-signin of Ingress claimed by this instance, if not set.
+// Controllers configured by other objects (Traefik Middlewares) are left as is.
+func (wh *Webhook) mutate(request *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	if request.Operation == admissionv1beta1.Delete {
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+	ingress, err := decodeIngress(request)
+	if err != nil {
+		return deny(err.Error())
+	}
+	if !wh.Observer.ingressObserved(ingress) {
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+
+	instance := wh.Observer.Controller.Instance
+	lookup := annotationLookup(ingress.Annotations, instance.AnnotationPrefix)
+	appName, ok := lookup("app-name")
+	adapter := instance.ingressAdapter(ingress.Annotations["kubernetes.io/ingress.class"])
+	if !ok || adapter == nil {
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+	settings := &models.ServiceSettings{IngressController: adapter.Name(), AppName: strings.TrimSpace(appName)}
+	settings.AuthHost, _ = lookup("auth-host")
+	if value, ok := lookup("sharing"); ok {
+		settings.Sharing, _ = parseProxySharing(value)
+	}
+	// allowed_groups of oauth2_proxy shared by the org
+	org, _ := lookup("github-org")
+	teams, _ := lookup("github-teams")
+	settings.GitHub.Organization = strings.TrimSpace(org)
+	settings.GitHub.Teams, _ = parseGitHubTeams(teams)
+	if len(validateAppName(settings.AppName)) != 0 {
+		// Rejected by validation
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+
+	authURL, authSignIn := wh.Observer.Controller.authURLs(settings)
+	patch := []map[string]string{}
+	for _, annotation := range adapter.authAnnotations(authURL, authSignIn) {
+		if _, ok := ingress.Annotations[annotation[0]]; !ok {
+			patch = append(patch, map[string]string{
+				"op":    "add",
+				"path":  "/metadata/annotations/" + strings.Replace(annotation[0], "/", "~1", -1),
+				"value": annotation[1],
+			})
+		}
+	}
+	if len(patch) == 0 {
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return deny(err.Error())
+	}
+	logrus.Infof("[Webhook] Filling auth-url / auth-signin of Ingress %s/%s", request.Namespace, ingress.Name)
+	patchType := admissionv1beta1.PatchTypeJSONPatch
+	return &admissionv1beta1.AdmissionResponse{
+		Allowed:   true,
+		Patch:     data,
+		PatchType: &patchType,
+	}
+}
+
+// authURLs - auth-url / auth-signin of Ingress protected by oauth2_proxy of the app.
+// With oauth2_proxy shared by the org, auth-url checks teams of the app by allowed_groups.
+// auth-signin is empty if the controller has no sign-in redirect.
+func (c *Controller) authURLs(settings *models.ServiceSettings) (string, string) {
+	c.settingsMu.RLock()
+	defer c.settingsMu.RUnlock()
+	proxy := c.servingProxy(settings)
+	base := fmt.Sprintf("https://%s%s", c.authHost(proxy), proxyPath(proxy))
+	authURL := base + "/auth"
+	if proxy != settings {
+		authURL += "?allowed_groups=" + allowedGroups(settings)
+	}
+	redirect := appIngressAdapter(settings).signInRedirect()
+	if len(redirect) == 0 {
+		return authURL, ""
+	}
+	return authURL, base + "/start?rd=" + redirect
+}
+
+// checkAuthURL - Host and path of value must be the ones of expected, and allowed_groups too if expected has it
+func checkAuthURL(value, expected string) error {
+	actual, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("%q is invalid: %s", value, err)
+	}
+	want, _ := url.Parse(expected)
+	if actual.Host != want.Host || actual.Path != want.Path {
+		return fmt.Errorf("%q must point to %s://%s%s", value, want.Scheme, want.Host, want.Path)
+	}
+	if groups := want.Query().Get("allowed_groups"); len(groups) != 0 && actual.Query().Get("allowed_groups") != groups {
+		return fmt.Errorf("%q must have allowed_groups=%s", value, groups)
+	}
+	return nil
+}
+
+// decodeIngress - Ingress in AdmissionRequest (extensions/v1beta1 or networking.k8s.io/v1beta1)
+func decodeIngress(request *admissionv1beta1.AdmissionRequest) (*v1beta1.Ingress, error) {
+	ingress := &v1beta1.Ingress{}
+	if err := json.Unmarshal(request.Object.Raw, ingress); err != nil {
+		return nil, fmt.Errorf("failed to decode Ingress: %s", err)
+	}
+	if len(ingress.Namespace) == 0 {
+		ingress.Namespace = request.Namespace
+	}
+	return ingress, nil
+}
+
+func deny(message string) *admissionv1beta1.AdmissionResponse {
+	return &admissionv1beta1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonInvalid,
+			Message: message,
+		},
+	}
+}
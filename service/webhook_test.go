@@ -0,0 +1,502 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/api/extensions/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/Laica-Lunasys/oauth2-proxy-manager/models"
+)
+
+func newTestWebhook(t *testing.T) (*Webhook, *httptest.Server) {
+	return newTestWebhookWithConfig(t, newTestConfig())
+}
+
+func newTestWebhookWithConfig(t *testing.T, cfg *Config) (*Webhook, *httptest.Server) {
+	controller, clientset := newTestController(t, cfg)
+	observer, err := NewObserver(clientset, controller, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhook := NewWebhook(observer)
+	server := httptest.NewServer(webhook.Handler())
+	return webhook, server
+}
+
+// review - Send Ingress to the webhook path, and return the response
+func review(t *testing.T, server *httptest.Server, path string, ingress *v1beta1.Ingress) *admissionv1beta1.AdmissionResponse {
+	return reviewObject(t, server, path, ingress.Namespace, ingress)
+}
+
+func reviewObject(t *testing.T, server *httptest.Server, path string, namespace string, obj interface{}) *admissionv1beta1.AdmissionResponse {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(&admissionv1beta1.AdmissionReview{
+		Request: &admissionv1beta1.AdmissionRequest{
+			UID:       types.UID("request-uid"),
+			Namespace: namespace,
+			Operation: admissionv1beta1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(server.URL+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	result := &admissionv1beta1.AdmissionReview{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Response == nil || result.Response.UID != "request-uid" {
+		t.Fatalf("response should have UID of request, got %+v", result.Response)
+	}
+	return result.Response
+}
+
+func TestWebhookValidate(t *testing.T) {
+	webhook, server := newTestWebhook(t)
+	defer server.Close()
+	webhook.Observer.stores[0].Add(newTestIngress("taken", nil))
+
+	unmanaged := newTestIngress("unmanaged", nil)
+	delete(unmanaged.Annotations, "oauth2-proxy-manager.k8s.io/app-name")
+	noAuthURL := newTestIngress("supersecret", nil)
+	delete(noAuthURL.Annotations, "nginx.ingress.kubernetes.io/auth-url")
+	collision := newTestIngress("collision", map[string]string{
+		"oauth2-proxy-manager.k8s.io/app-name": "taken",
+	})
+
+	cases := []struct {
+		name    string
+		ingress *v1beta1.Ingress
+		message string
+	}{
+		{name: "valid", ingress: newTestIngress("supersecret", nil)},
+		{name: "unmanaged", ingress: unmanaged},
+		{name: "invalid annotations", ingress: newTestIngress("supersecret", map[string]string{
+			"oauth2-proxy-manager.k8s.io/github-teams": "admin,,dev",
+			"oauth2-proxy-manager.k8s.io/replicas":     "many",
+		}), message: "invalid annotations: github-teams"},
+		{name: "hpa without replicas", ingress: newTestIngress("supersecret", map[string]string{
+			"oauth2-proxy-manager.k8s.io/replicas": "0",
+			"oauth2-proxy-manager.k8s.io/hpa":      "true",
+		}), message: "replicas 0 can't be used with hpa"},
+		{name: "auth-host with path", ingress: newTestIngress("supersecret", map[string]string{
+			"oauth2-proxy-manager.k8s.io/auth-host": "auth.example.com/evil",
+		}), message: `auth-host "auth.example.com/evil" is invalid`},
+		{name: "cookie-domain with spaces", ingress: newTestIngress("supersecret", map[string]string{
+			"oauth2-proxy-manager.k8s.io/cookie-domain": ".example.com --skip-auth-regex=.*",
+		}), message: "cookie-domain"},
+		{name: "whitelist-domain", ingress: newTestIngress("supersecret", map[string]string{
+			"oauth2-proxy-manager.k8s.io/whitelist-domain": ".example.com,EVIL_",
+		}), message: `whitelist-domain "EVIL_" is invalid`},
+		{name: "valid domains", ingress: newTestIngress("supersecret", map[string]string{
+			"oauth2-proxy-manager.k8s.io/auth-host":        "auth.example.com",
+			"oauth2-proxy-manager.k8s.io/cookie-domain":    ".example.com",
+			"oauth2-proxy-manager.k8s.io/whitelist-domain": ".example.com,.example.net",
+		})},
+		{name: "image with tag", ingress: newTestIngress("supersecret", map[string]string{
+			"oauth2-proxy-manager.k8s.io/image": "registry.example.com:5000/oauth2-proxy:v7.1.3",
+		}), message: "must be repository without tag or digest"},
+		{name: "image of registry with port", ingress: newTestIngress("supersecret", map[string]string{
+			"oauth2-proxy-manager.k8s.io/image": "registry.example.com:5000/oauth2-proxy",
+		})},
+		{name: "missing auth-url", ingress: noAuthURL, message: "auth-url not found"},
+		{name: "collision", ingress: collision, message: `app-name "taken" of github-org "example-corp" is already used by Ingress taken/taken`},
+		{name: "auth-url of other app", ingress: newTestIngress("supersecret", map[string]string{
+			"nginx.ingress.kubernetes.io/auth-url": "https://auth.example.com/github/other/auth",
+		}), message: "must point to https://auth.example.com/github/supersecret/auth"},
+		{name: "auth-signin of other host", ingress: newTestIngress("supersecret", map[string]string{
+			"oauth2-proxy-manager.k8s.io/auth-host": "auth.example.net",
+		}), message: "must point to https://auth.example.net/github/supersecret/start"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			response := review(t, server, "/validate", tc.ingress)
+			if len(tc.message) == 0 {
+				if !response.Allowed {
+					t.Errorf("should be allowed, got %+v", response.Result)
+				}
+				return
+			}
+			if response.Allowed {
+				t.Fatal("should be denied")
+			}
+			if !strings.Contains(response.Result.Message, tc.message) {
+				t.Errorf("message = %q, want to contain %q", response.Result.Message, tc.message)
+			}
+		})
+	}
+}
+
+func TestWebhookMutate(t *testing.T) {
+	_, server := newTestWebhook(t)
+	defer server.Close()
+
+	ingress := newTestIngress("supersecret", map[string]string{
+		"oauth2-proxy-manager.k8s.io/auth-host": "auth.example.net",
+	})
+	delete(ingress.Annotations, "nginx.ingress.kubernetes.io/auth-url")
+	delete(ingress.Annotations, "nginx.ingress.kubernetes.io/auth-signin")
+	response := review(t, server, "/mutate", ingress)
+	if !response.Allowed || response.PatchType == nil || *response.PatchType != admissionv1beta1.PatchTypeJSONPatch {
+		t.Fatalf("should be allowed with JSON patch, got %+v", response)
+	}
+	want := `[{"op":"add","path":"/metadata/annotations/nginx.ingress.kubernetes.io~1auth-url","value":"https://auth.example.net/github/supersecret/auth"},` +
+		`{"op":"add","path":"/metadata/annotations/nginx.ingress.kubernetes.io~1auth-signin","value":"https://auth.example.net/github/supersecret/start?rd=https://$host$request_uri$is_args$args"}]`
+	if string(response.Patch) != want {
+		t.Errorf("patch = %s, want %s", response.Patch, want)
+	}
+
+	// Annotations set by user are kept
+	response = review(t, server, "/mutate", newTestIngress("supersecret", nil))
+	if !response.Allowed || len(response.Patch) != 0 {
+		t.Errorf("should be allowed without patch, got %+v", response)
+	}
+}
+
+func TestWebhookScope(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.WatchNamespaces = "tenant-a"
+	cfg.IngressSelector = "oauth2-proxy=enabled"
+	webhook, server := newTestWebhookWithConfig(t, cfg)
+	defer server.Close()
+
+	newIngress := func(namespace string, labels map[string]string) *v1beta1.Ingress {
+		ingress := newTestIngress("supersecret", map[string]string{
+			"oauth2-proxy-manager.k8s.io/github-teams": "admin,,dev",
+		})
+		delete(ingress.Annotations, "nginx.ingress.kubernetes.io/auth-url")
+		ingress.Namespace = namespace
+		ingress.Labels = labels
+		return ingress
+	}
+	selected := map[string]string{"oauth2-proxy": "enabled"}
+
+	// Ingresses of other managers are left as is
+	for _, ingress := range []*v1beta1.Ingress{newIngress("tenant-b", selected), newIngress("tenant-a", nil)} {
+		for _, path := range []string{"/validate", "/mutate"} {
+			if response := review(t, server, path, ingress); !response.Allowed || len(response.Patch) != 0 {
+				t.Errorf("%s %s/%s should be allowed as is, got %+v", path, ingress.Namespace, ingress.Labels, response)
+			}
+		}
+	}
+	if response := review(t, server, "/validate", newIngress("tenant-a", selected)); response.Allowed {
+		t.Error("observed Ingress should be validated")
+	}
+
+	// Not blocked by running Apply
+	webhook.Observer.Controller.mu.Lock()
+	defer webhook.Observer.Controller.mu.Unlock()
+	done := make(chan *admissionv1beta1.AdmissionResponse)
+	go func() {
+		done <- review(t, server, "/mutate", newIngress("tenant-a", selected))
+	}()
+	select {
+	case response := <-done:
+		if len(response.Patch) == 0 {
+			t.Errorf("auth-url should be filled, got %+v", response)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook waits for Apply")
+	}
+}
+
+func TestWebhookIngressControllers(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.IngressControllers = "nginx,traefik,haproxy"
+	controller, clientset := newTestController(t, cfg)
+	controller.Dynamic = dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "traefik.containo.us/v1alpha1",
+		"kind":       "Middleware",
+		"metadata":   map[string]interface{}{"name": "oauth2", "namespace": "supersecret"},
+		"spec": map[string]interface{}{
+			"forwardAuth": map[string]interface{}{"address": "https://auth.example.com/github/supersecret/auth"},
+		},
+	}})
+	observer, err := NewObserver(clientset, controller, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewWebhook(observer).Handler())
+	defer server.Close()
+
+	traefik := func(middlewares string) *v1beta1.Ingress {
+		ingress := newTestIngress("supersecret", map[string]string{
+			"kubernetes.io/ingress.class":                      "traefik",
+			"traefik.ingress.kubernetes.io/router.middlewares": middlewares,
+		})
+		delete(ingress.Annotations, "nginx.ingress.kubernetes.io/auth-url")
+		delete(ingress.Annotations, "nginx.ingress.kubernetes.io/auth-signin")
+		return ingress
+	}
+
+	// ForwardAuth address is read from Middleware
+	if response := review(t, server, "/validate", traefik("supersecret-strip@kubernetescrd,supersecret-oauth2@kubernetescrd")); !response.Allowed {
+		t.Errorf("should be allowed, got %+v", response.Result)
+	}
+	response := review(t, server, "/validate", traefik("supersecret-strip@kubernetescrd"))
+	if response.Allowed || !strings.Contains(response.Result.Message, "no ForwardAuth Middleware") {
+		t.Errorf("should be denied without ForwardAuth, got %+v", response.Result)
+	}
+	if response := review(t, server, "/mutate", traefik("supersecret-oauth2@kubernetescrd")); !response.Allowed || len(response.Patch) != 0 {
+		t.Errorf("Traefik Ingress should be allowed without patch, got %+v", response)
+	}
+
+	// HAProxy Ingress has its own annotations
+	haproxy := newTestIngress("supersecret", map[string]string{"kubernetes.io/ingress.class": "haproxy"})
+	delete(haproxy.Annotations, "nginx.ingress.kubernetes.io/auth-url")
+	delete(haproxy.Annotations, "nginx.ingress.kubernetes.io/auth-signin")
+	response = review(t, server, "/mutate", haproxy)
+	want := `[{"op":"add","path":"/metadata/annotations/haproxy-ingress.github.io~1auth-url","value":"https://auth.example.com/github/supersecret/auth"},` +
+		`{"op":"add","path":"/metadata/annotations/haproxy-ingress.github.io~1auth-signin","value":"https://auth.example.com/github/supersecret/start?rd=https://%[hdr(host)]%[path]"}]`
+	if string(response.Patch) != want {
+		t.Errorf("patch = %s, want %s", response.Patch, want)
+	}
+}
+
+func TestWebhookSharedProxy(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.Version = "v7.1.3"
+	cfg.Proxy["sharing"] = ProxySharingPerOrg
+	controller, clientset := newTestController(t, cfg)
+	observer, err := NewObserver(clientset, controller, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewWebhook(observer).Handler())
+	defer server.Close()
+
+	ingress := newTestIngress("supersecret", nil)
+	delete(ingress.Annotations, "nginx.ingress.kubernetes.io/auth-url")
+	delete(ingress.Annotations, "nginx.ingress.kubernetes.io/auth-signin")
+	response := review(t, server, "/mutate", ingress)
+	if !strings.Contains(string(response.Patch), `"value":"https://auth.example.com/github-org/example-corp/auth?allowed_groups=example-corp:admin,example-corp:dev"`) {
+		t.Errorf("auth-url should have allowed_groups of the app, got %s", response.Patch)
+	}
+
+	// Without allowed_groups, every member of the org passes
+	response = review(t, server, "/validate", newTestIngress("supersecret", map[string]string{
+		"nginx.ingress.kubernetes.io/auth-url":    "https://auth.example.com/github-org/example-corp/auth",
+		"nginx.ingress.kubernetes.io/auth-signin": "https://auth.example.com/github-org/example-corp/start",
+	}))
+	if response.Allowed || !strings.Contains(response.Result.Message, "must have allowed_groups=example-corp:admin,example-corp:dev") {
+		t.Errorf("should be denied without allowed_groups, got %+v", response.Result)
+	}
+}
+
+func TestWebhookInject(t *testing.T) {
+	webhook, server := newTestWebhook(t)
+	defer server.Close()
+	clientset := webhook.Observer.Controller.Clientset
+
+	newPod := func(annotations map[string]string) *apiv1.Pod {
+		pod := &apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				GenerateName: "dashboard-",
+				Namespace:    "monitoring",
+				Annotations: map[string]string{
+					"oauth2-proxy-manager.k8s.io/app-name":     "dashboard",
+					"oauth2-proxy-manager.k8s.io/github-org":   "example-corp",
+					"oauth2-proxy-manager.k8s.io/github-teams": "admin",
+				},
+			},
+			Spec: apiv1.PodSpec{
+				Containers: []apiv1.Container{{Name: "dashboard", Image: "dashboard"}},
+			},
+		}
+		for k, v := range annotations {
+			pod.Annotations[k] = v
+		}
+		return pod
+	}
+
+	// Not asked for
+	response := reviewObject(t, server, "/inject", "monitoring", newPod(nil))
+	if !response.Allowed || len(response.Patch) != 0 {
+		t.Fatalf("should be allowed without patch, got %+v", response)
+	}
+
+	// Upstream port is required
+	response = reviewObject(t, server, "/inject", "monitoring", newPod(map[string]string{
+		"oauth2-proxy-manager.k8s.io/sidecar": "true",
+	}))
+	if response.Allowed || !strings.Contains(response.Result.Message, "sidecar-upstream-port") {
+		t.Fatalf("should be denied for sidecar-upstream-port, got %+v", response)
+	}
+
+	pod := newPod(map[string]string{
+		"oauth2-proxy-manager.k8s.io/sidecar":               "true",
+		"oauth2-proxy-manager.k8s.io/sidecar-upstream-port": "8080",
+		"oauth2-proxy-manager.k8s.io/sidecar-redirect-url":  "https://dashboard.example.com/oauth2/callback",
+	})
+	response = reviewObject(t, server, "/inject", "monitoring", pod)
+	if !response.Allowed || response.PatchType == nil || *response.PatchType != admissionv1beta1.PatchTypeJSONPatch {
+		t.Fatalf("should be allowed with JSON patch, got %+v", response)
+	}
+	patch := []struct {
+		Op    string
+		Path  string
+		Value json.RawMessage
+	}{}
+	if err := json.Unmarshal(response.Patch, &patch); err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) != 2 || patch[0].Path != "/spec/containers/-" || patch[1].Path != "/spec/volumes" {
+		t.Fatalf("patch = %s", response.Patch)
+	}
+	container := apiv1.Container{}
+	if err := json.Unmarshal(patch[0].Value, &container); err != nil {
+		t.Fatal(err)
+	}
+	args := strings.Join(container.Args, " ")
+	for _, want := range []string{
+		"--http-address=0.0.0.0:4180",
+		"--upstream=http://127.0.0.1:8080",
+		"--redirect-url=https://dashboard.example.com/oauth2/callback",
+		"--github-org=example-corp",
+	} {
+		if !strings.Contains(args, want) {
+			t.Errorf("args should contain %s, got %s", want, args)
+		}
+	}
+	for _, unwanted := range []string{"--proxy-prefix=", "--cookie-domain=", "file:///dev/null"} {
+		if strings.Contains(args, unwanted) {
+			t.Errorf("args should not contain %s, got %s", unwanted, args)
+		}
+	}
+	if container.Ports[0].Name != sidecarPortName || container.VolumeMounts[0].Name != sidecarVolumeName {
+		t.Errorf("port / volume should not collide with the app, got %+v", container)
+	}
+
+	// Secret / ConfigMap in namespace of the Pod
+	name := proxyName(&models.ServiceSettings{AppName: "dashboard", GitHub: models.GitHubProvider{Organization: "example-corp"}})
+	if _, err := clientset.CoreV1().Secrets("monitoring").Get(name, metav1.GetOptions{}); err != nil {
+		t.Errorf("Secret should be created in namespace of the Pod: %s", err)
+	}
+	if _, err := clientset.CoreV1().ConfigMaps("monitoring").Get(name, metav1.GetOptions{}); err != nil {
+		t.Errorf("ConfigMap should be created in namespace of the Pod: %s", err)
+	}
+
+	// Injected already
+	pod.Spec.Containers = append(pod.Spec.Containers, container)
+	response = reviewObject(t, server, "/inject", "monitoring", pod)
+	if !response.Allowed || len(response.Patch) != 0 {
+		t.Errorf("should be allowed without patch, got %+v", response)
+	}
+
+	exists := func() bool {
+		_, secretErr := clientset.CoreV1().Secrets("monitoring").Get(name, metav1.GetOptions{})
+		_, configMapErr := clientset.CoreV1().ConfigMaps("monitoring").Get(name, metav1.GetOptions{})
+		return secretErr == nil && configMapErr == nil
+	}
+
+	// Other objects labeled by the instance are not sidecars
+	other := &apiv1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "monitoring", Labels: webhook.Observer.Controller.Instance.labels()}}
+	if _, err := clientset.CoreV1().Secrets("monitoring").Create(other); err != nil {
+		t.Fatal(err)
+	}
+
+	// Kept while the Pod may be created
+	webhook.CleanupSidecars()
+	if !exists() {
+		t.Fatal("Secret / ConfigMap of Pod being created should be kept")
+	}
+
+	// Kept while a Pod uses them
+	webhook.Observer.Controller.sidecars["monitoring/"+name] = time.Now().Add(-sidecarGracePeriod)
+	pod.Name = "dashboard-1"
+	if err := json.Unmarshal(patch[1].Value, &pod.Spec.Volumes); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientset.CoreV1().Pods("monitoring").Create(pod); err != nil {
+		t.Fatal(err)
+	}
+	webhook.CleanupSidecars()
+	if !exists() {
+		t.Fatal("Secret / ConfigMap used by Pod should be kept")
+	}
+
+	// Deleted with the last Pod
+	if err := clientset.CoreV1().Pods("monitoring").Delete(pod.Name, &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	webhook.CleanupSidecars()
+	if _, err := clientset.CoreV1().Secrets("monitoring").Get(name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Secret should be deleted, got err=%v", err)
+	}
+	if _, err := clientset.CoreV1().ConfigMaps("monitoring").Get(name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("ConfigMap should be deleted, got err=%v", err)
+	}
+	if _, err := clientset.CoreV1().Secrets("monitoring").Get(other.Name, metav1.GetOptions{}); err != nil {
+		t.Errorf("Secret not applied for sidecar should be kept, got err=%v", err)
+	}
+
+	// API error denies the Pod, without failing the request
+	clientset.(*fake.Clientset).PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("etcd is down")
+	})
+	pod.Spec.Containers = pod.Spec.Containers[:1]
+	response = reviewObject(t, server, "/inject", "monitoring", pod)
+	if response.Allowed || !strings.Contains(response.Result.Message, "etcd is down") {
+		t.Errorf("should be denied with API error, got %+v", response)
+	}
+}
+
+func TestWebhookInjectScope(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.WatchNamespaces = "monitoring"
+	webhook, server := newTestWebhookWithConfig(t, cfg)
+	defer server.Close()
+
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "dashboard",
+			Annotations: map[string]string{
+				"oauth2-proxy-manager.k8s.io/app-name":              "dashboard",
+				"oauth2-proxy-manager.k8s.io/github-org":            "example-corp",
+				"oauth2-proxy-manager.k8s.io/github-teams":          "admin",
+				"oauth2-proxy-manager.k8s.io/sidecar":               "true",
+				"oauth2-proxy-manager.k8s.io/sidecar-upstream-port": "8080",
+			},
+		},
+	}
+	response := reviewObject(t, server, "/inject", "tenant", pod)
+	if response.Allowed || !strings.Contains(response.Result.Message, "not observed") {
+		t.Errorf("Pod outside observed namespaces should be denied, got %+v", response)
+	}
+	secrets, err := webhook.Observer.Controller.Clientset.CoreV1().Secrets("tenant").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets.Items) != 0 {
+		t.Errorf("client secret should not be written in tenant, got %d Secrets", len(secrets.Items))
+	}
+}